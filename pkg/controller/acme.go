@@ -0,0 +1,336 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	client "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	acmeAccountKey    = "account.key"
+	// acmeChallengeSuffix is appended to the name of the account secret to name
+	// the secret which shares the challenge tokens with the other replicas
+	acmeChallengeSuffix = "-challenges"
+	// acmeChallengeDelay is how long to wait before accepting a challenge, so
+	// the request of the ACME server can reach any replica
+	acmeChallengeDelay = 2 * time.Second
+	// acmeRenewBefore is how long before the expiration a certificate is renewed
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// acmeRetryInterval is the minimum time between two orders of the same secret
+	acmeRetryInterval = time.Hour
+)
+
+// acmeManager issues the certificates of ingress resources with the acme
+// annotation and stores them in the TLS secret of the ingress. The ingress
+// core reads the secret and configures the hostnames as HTTPS, so the
+// controller doesn't need to track the issued certificates.
+type acmeManager struct {
+	kubeClient    *client.Clientset
+	server        string
+	email         string
+	accountSecret string
+	port          int
+	client        *acmeClient
+	issueMutex    sync.Mutex
+	mutex         sync.Mutex
+	tokens        map[string]string
+	queued        map[string]bool
+	failures      map[string]time.Time
+}
+
+func newAcmeManager(kubeClient *client.Clientset, server, email, accountSecret string, port int) (*acmeManager, error) {
+	if strings.Count(accountSecret, "/") != 1 {
+		return nil, fmt.Errorf("invalid account secret format (namespace/name): %v", accountSecret)
+	}
+	return &acmeManager{
+		kubeClient:    kubeClient,
+		server:        server,
+		email:         email,
+		accountSecret: accountSecret,
+		port:          port,
+		tokens:        map[string]string{},
+		queued:        map[string]bool{},
+		failures:      map[string]time.Time{},
+	}, nil
+}
+
+// startSolver serves the http-01 challenges, HAProxy sends
+// requests to /.well-known/acme-challenge/ to this port
+func (m *acmeManager) startSolver() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(acmeChallengePath, m.handleChallenge)
+	server := &http.Server{
+		Addr:    fmt.Sprintf("127.0.0.1:%v", m.port),
+		Handler: mux,
+	}
+	glog.Fatal(server.ListenAndServe())
+}
+
+// handleChallenge answers the tokens of the challenges ordered by this
+// replica, and the tokens shared by other replicas in the challenge secret,
+// so the challenge is answered no matter which replica receives the request
+func (m *acmeManager) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+	m.mutex.Lock()
+	keyAuth, found := m.tokens[token]
+	m.mutex.Unlock()
+	if !found {
+		keyAuth, found = m.sharedToken(token)
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+}
+
+func (m *acmeManager) sharedToken(token string) (string, bool) {
+	namespace, name := splitSecretName(m.challengeSecret())
+	secret, err := m.kubeClient.Core().Secrets(namespace).Get(name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			glog.Warningf("error reading ACME challenge secret: %v", err)
+		}
+		return "", false
+	}
+	keyAuth, found := secret.Data[token]
+	return string(keyAuth), found
+}
+
+func (m *acmeManager) setToken(token, keyAuth string) error {
+	m.mutex.Lock()
+	m.tokens[token] = keyAuth
+	m.mutex.Unlock()
+	if err := m.storeSecret(m.challengeSecret(), map[string][]byte{token: []byte(keyAuth)}); err != nil {
+		return fmt.Errorf("error sharing ACME challenge token: %v", err)
+	}
+	time.Sleep(acmeChallengeDelay)
+	return nil
+}
+
+func (m *acmeManager) removeToken(token string) {
+	m.mutex.Lock()
+	delete(m.tokens, token)
+	m.mutex.Unlock()
+	if err := m.removeSecretKey(m.challengeSecret(), token); err != nil {
+		glog.Warningf("error removing ACME challenge token: %v", err)
+	}
+}
+
+func (m *acmeManager) challengeSecret() string {
+	return m.accountSecret + acmeChallengeSuffix
+}
+
+// check orders a certificate for every TLS secret of the ingress resources with
+// the acme annotation whose certificate is missing, expiring or doesn't cover
+// all of the hostnames. Orders run in the background, one at a time.
+func (m *acmeManager) check(anns *ingressAnnotations) {
+	for _, ing := range anns.ingresses {
+		if acme, _ := strconv.ParseBool(trimAnnotations(ing.Annotations)["acme"]); !acme {
+			continue
+		}
+		for _, tls := range ing.Spec.TLS {
+			if tls.SecretName == "" || len(tls.Hosts) == 0 {
+				continue
+			}
+			secretName := ing.Namespace + "/" + tls.SecretName
+			if acmeCertificateValid(anns, secretName, tls.Hosts) {
+				continue
+			}
+			m.enqueue(secretName, tls.Hosts)
+		}
+	}
+}
+
+func (m *acmeManager) enqueue(secretName string, hosts []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.queued[secretName] {
+		return
+	}
+	if failure, found := m.failures[secretName]; found && time.Since(failure) < acmeRetryInterval {
+		return
+	}
+	m.queued[secretName] = true
+	go m.issue(secretName, hosts)
+}
+
+func (m *acmeManager) issue(secretName string, hosts []string) {
+	m.issueMutex.Lock()
+	defer m.issueMutex.Unlock()
+	glog.Infof("ordering certificate of %v to secret %v", hosts, secretName)
+	err := m.order(secretName, hosts)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.queued, secretName)
+	if err != nil {
+		glog.Warningf("error ordering certificate of %v: %v", hosts, err)
+		m.failures[secretName] = time.Now()
+		return
+	}
+	glog.Infof("certificate of %v stored in secret %v", hosts, secretName)
+	delete(m.failures, secretName)
+}
+
+func (m *acmeManager) order(secretName string, hosts []string) error {
+	if m.client == nil {
+		key, err := m.accountKey()
+		if err != nil {
+			return err
+		}
+		acmeClient := newAcmeClient(m.server, key)
+		if err := acmeClient.register(m.email); err != nil {
+			return err
+		}
+		m.client = acmeClient
+	}
+	cert, key, err := m.client.obtain(hosts, m)
+	if err != nil {
+		return err
+	}
+	return m.storeSecret(secretName, map[string][]byte{
+		api.TLSCertKey:       cert,
+		api.TLSPrivateKeyKey: key,
+	})
+}
+
+// accountKey reads the private key of the ACME account from the account
+// secret, a new key is created and stored if the secret doesn't exist
+func (m *acmeManager) accountKey() (*ecdsa.PrivateKey, error) {
+	namespace, name := splitSecretName(m.accountSecret)
+	secret, err := m.kubeClient.Core().Secrets(namespace).Get(name)
+	if err == nil {
+		block, _ := pem.Decode(secret.Data[acmeAccountKey])
+		if block == nil {
+			return nil, fmt.Errorf("secret %v doesn't have a PEM encoded %v", m.accountSecret, acmeAccountKey)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = m.storeSecret(m.accountSecret, map[string][]byte{
+		acmeAccountKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+	})
+	return key, err
+}
+
+// storeSecret creates or updates the keys of a secret, other keys are preserved
+func (m *acmeManager) storeSecret(secretName string, data map[string][]byte) error {
+	namespace, name := splitSecretName(secretName)
+	secretAPI := m.kubeClient.Core().Secrets(namespace)
+	secret, err := secretAPI.Get(name)
+	if errors.IsNotFound(err) {
+		secret = &api.Secret{
+			ObjectMeta: api.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+			Data: data,
+		}
+		if _, hasCert := data[api.TLSCertKey]; hasCert {
+			secret.Type = api.SecretTypeTLS
+		}
+		_, err = secretAPI.Create(secret)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for key, value := range data {
+		secret.Data[key] = value
+	}
+	_, err = secretAPI.Update(secret)
+	return err
+}
+
+// removeSecretKey removes a key of a secret, if both exist
+func (m *acmeManager) removeSecretKey(secretName, key string) error {
+	namespace, name := splitSecretName(secretName)
+	secretAPI := m.kubeClient.Core().Secrets(namespace)
+	secret, err := secretAPI.Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, found := secret.Data[key]; !found {
+		return nil
+	}
+	delete(secret.Data, key)
+	_, err = secretAPI.Update(secret)
+	return err
+}
+
+// acmeCertificateValid checks if the certificate of a secret covers all
+// the hostnames and doesn't need to be renewed
+func acmeCertificateValid(anns *ingressAnnotations, secretName string, hosts []string) bool {
+	if anns.lister == nil {
+		return false
+	}
+	obj, exists, err := anns.lister.Secret.GetByKey(secretName)
+	if err != nil || !exists {
+		return false
+	}
+	block, _ := pem.Decode(obj.(*api.Secret).Data[api.TLSCertKey])
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || time.Now().Add(acmeRenewBefore).After(cert.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func splitSecretName(secretName string) (namespace, name string) {
+	names := strings.SplitN(secretName, "/", 2)
+	return names[0], names[1]
+}
@@ -0,0 +1,348 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+const (
+	acmeBadNonce     = "urn:ietf:params:acme:error:badNonce"
+	acmePollInterval = 2 * time.Second
+	acmePollAttempts = 60
+)
+
+// acmeClient implements the subset of the ACME protocol, RFC 8555, used to
+// order certificates whose hostnames are validated with the http-01 challenge
+type acmeClient struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	httpClient   *http.Client
+	directory    acmeDirectory
+	account      string
+	nonce        string
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) String() string {
+	if p == nil {
+		return "unknown error"
+	}
+	return p.Detail
+}
+
+// acmeSolver publishes the key authorization of http-01 challenges,
+// which is read by the ACME server from /.well-known/acme-challenge/<token>
+type acmeSolver interface {
+	setToken(token, keyAuth string) error
+	removeToken(token string)
+}
+
+func newAcmeClient(directoryURL string, key *ecdsa.PrivateKey) *acmeClient {
+	return &acmeClient{
+		directoryURL: directoryURL,
+		key:          key,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// register reads the directory of the ACME server and creates the account
+// of the client key, or reuses the account if it already exists
+func (c *acmeClient) register(email string) error {
+	resp, err := c.httpClient.Get(c.directoryURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error reading ACME directory: %v", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.directory); err != nil {
+		return err
+	}
+	account := map[string]interface{}{
+		"termsOfServiceAgreed": true,
+	}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	header, _, err := c.post(c.directory.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	c.account = header.Get("Location")
+	return nil
+}
+
+// obtain orders a certificate of hosts, returning the PEM encoded
+// certificate chain and the private key of the certificate
+func (c *acmeClient) obtain(hosts []string, solver acmeSolver) (certPEM, keyPEM []byte, err error) {
+	identifiers := make([]acmeIdentifier, len(hosts))
+	for i, host := range hosts {
+		identifiers[i] = acmeIdentifier{Type: "dns", Value: host}
+	}
+	order := &acmeOrder{}
+	header, _, err := c.post(c.directory.NewOrder, map[string]interface{}{"identifiers": identifiers}, order)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := header.Get("Location")
+	for _, authzURL := range order.Authorizations {
+		if err := c.authorize(authzURL, solver); err != nil {
+			return nil, nil, err
+		}
+	}
+	certKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: hosts[0]},
+		DNSNames: hosts,
+	}, certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := c.post(order.Finalize, map[string]string{"csr": base64URL(csr)}, order); err != nil {
+		return nil, nil, err
+	}
+	for i := 0; order.Status != "valid"; i++ {
+		if order.Status == "invalid" {
+			return nil, nil, fmt.Errorf("order of %v is invalid: %v", hosts, order.Error)
+		}
+		if i == acmePollAttempts {
+			return nil, nil, fmt.Errorf("timeout waiting order of %v, last status: %v", hosts, order.Status)
+		}
+		time.Sleep(acmePollInterval)
+		if _, _, err := c.post(orderURL, nil, order); err != nil {
+			return nil, nil, err
+		}
+	}
+	_, certPEM, err = c.post(order.Certificate, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(certKey)})
+	return certPEM, keyPEM, nil
+}
+
+// authorize answers the http-01 challenge of an authorization
+// and waits the ACME server to validate it
+func (c *acmeClient) authorize(authzURL string, solver acmeSolver) error {
+	authz := &acmeAuthorization{}
+	if _, _, err := c.post(authzURL, nil, authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	var challenge *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "http-01" {
+			challenge = &authz.Challenges[i]
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("http-01 challenge of %v was not found", authz.Identifier.Value)
+	}
+	if err := solver.setToken(challenge.Token, challenge.Token+"."+c.thumbprint()); err != nil {
+		return err
+	}
+	defer solver.removeToken(challenge.Token)
+	if _, _, err := c.post(challenge.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+	for i := 0; i < acmePollAttempts; i++ {
+		time.Sleep(acmePollInterval)
+		if _, _, err := c.post(authzURL, nil, authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending":
+			continue
+		}
+		for _, chal := range authz.Challenges {
+			if chal.Type == "http-01" && chal.Error != nil {
+				return fmt.Errorf("challenge of %v failed: %v", authz.Identifier.Value, chal.Error)
+			}
+		}
+		return fmt.Errorf("authorization of %v is %v", authz.Identifier.Value, authz.Status)
+	}
+	return fmt.Errorf("timeout waiting authorization of %v", authz.Identifier.Value)
+}
+
+// post sends a JWS signed request, a nil payload is sent as POST-as-GET.
+// The response is decoded to out if it isn't nil.
+func (c *acmeClient) post(url string, payload interface{}, out interface{}) (http.Header, []byte, error) {
+	for retry := 0; ; retry++ {
+		body, err := c.sign(url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := c.httpClient.Post(url, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		c.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{}
+			json.Unmarshal(data, problem)
+			if problem.Type == acmeBadNonce && retry < 3 {
+				continue
+			}
+			return nil, nil, fmt.Errorf("ACME server returned %v: %v", resp.Status, problem.Detail)
+		}
+		if out != nil {
+			if err := json.Unmarshal(data, out); err != nil {
+				return nil, nil, err
+			}
+		}
+		return resp.Header, data, nil
+	}
+}
+
+func (c *acmeClient) sign(url string, payload interface{}) ([]byte, error) {
+	if c.nonce == "" {
+		resp, err := c.httpClient.Head(c.directory.NewNonce)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		c.nonce = resp.Header.Get("Replay-Nonce")
+	}
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": c.nonce,
+		"url":   url,
+	}
+	c.nonce = ""
+	if c.account != "" {
+		protected["kid"] = c.account
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	protectedData, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var payloadData []byte
+	if payload != nil {
+		if payloadData, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	signingInput := base64URL(protectedData) + "." + base64URL(payloadData)
+	hash := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]string{
+		"protected": base64URL(protectedData),
+		"payload":   base64URL(payloadData),
+		"signature": base64URL(append(padBytes(r, 32), padBytes(s, 32)...)),
+	})
+}
+
+// jwk is the public key of the account, keys are sorted as
+// required by the thumbprint, RFC 7638
+func (c *acmeClient) jwk() map[string]string {
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64URL(padBytes(c.key.X, 32)),
+		"y":   base64URL(padBytes(c.key.Y, 32)),
+	}
+}
+
+func (c *acmeClient) thumbprint() string {
+	// json.Marshal sorts map keys
+	jwk, _ := json.Marshal(c.jwk())
+	hash := sha256.Sum256(jwk)
+	return base64URL(hash[:])
+}
+
+func padBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func base64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
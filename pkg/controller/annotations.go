@@ -0,0 +1,386 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress"
+	"k8s.io/ingress/core/pkg/ingress/controller"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/util/intstr"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const annotationPrefix = "ingress.kubernetes.io/"
+
+// ingressAnnotations maps backends and locations back to the ingress resources
+// which declare them. ingress.Backend and ingress.Location don't have a reference
+// to the ingress or the service, so HAProxy specific annotations are read from
+// the lister. Ingress resources are read from the oldest to the newest one,
+// so the oldest ingress wins when more than one declares the same backend or location.
+// Annotation names are stored without the `ingress.kubernetes.io/` prefix,
+// so the same names used on ConfigMap can be used to decode them.
+type ingressAnnotations struct {
+	lister    *ingress.StoreLister
+	pods      *podWeights
+	events    *eventReporter
+	ingresses []*extensions.Ingress
+	backends  map[string]*ingressBackend
+	locations map[string]*extensions.Ingress
+	claims    map[string][]*locationClaim
+}
+
+type ingressBackend struct {
+	ingress     *extensions.Ingress
+	backend     *extensions.IngressBackend
+	annotations map[string]string
+}
+
+// locationClaim is an ingress which declares a hostname and path
+type locationClaim struct {
+	ingress *extensions.Ingress
+	backend *extensions.IngressBackend
+}
+
+// newIngressAnnotations reads the ingress resources of the same class of the
+// controller, using the same rules of the ingress core
+func newIngressAnnotations(lister *ingress.StoreLister, classConfig *controller.Configuration, namespaces *namespaceFilter) *ingressAnnotations {
+	anns := &ingressAnnotations{
+		lister:    lister,
+		backends:  map[string]*ingressBackend{},
+		locations: map[string]*extensions.Ingress{},
+		claims:    map[string][]*locationClaim{},
+	}
+	if lister == nil {
+		return anns
+	}
+	ings := ingressByAge{}
+	for _, obj := range lister.Ingress.Store.List() {
+		ing, ok := obj.(*extensions.Ingress)
+		if ok && (classConfig == nil || controller.IsValidClass(ing, classConfig)) && namespaces.allowed(ing.Namespace) {
+			ings = append(ings, ing)
+		}
+	}
+	sort.Sort(ings)
+	anns.ingresses = ings
+	for _, ing := range ings {
+		data := trimAnnotations(ing.Annotations)
+		if ing.Spec.Backend != nil {
+			anns.addBackend(ing, ing.Spec.Backend, data)
+		}
+		for _, rule := range ing.Spec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			for i := range rule.HTTP.Paths {
+				anns.addBackend(ing, &rule.HTTP.Paths[i].Backend, data)
+				anns.addLocation(ing, rule.Host, rule.HTTP.Paths[i].Path, &rule.HTTP.Paths[i].Backend)
+			}
+		}
+	}
+	return anns
+}
+
+// addBackend uses the same naming convention of the ingress core:
+// <namespace>-<service name>-<service port>. The first ingress
+// which references a backend wins.
+func (anns *ingressAnnotations) addBackend(ing *extensions.Ingress, backend *extensions.IngressBackend, data map[string]string) {
+	name := fmt.Sprintf("%v-%v-%v", ing.Namespace, backend.ServiceName, backend.ServicePort.String())
+	if _, found := anns.backends[name]; !found {
+		anns.backends[name] = &ingressBackend{
+			ingress:     ing,
+			backend:     backend,
+			annotations: data,
+		}
+	}
+}
+
+// addLocation uses the same defaults of the ingress core:
+// hostname `_` and path `/` if not declared
+func (anns *ingressAnnotations) addLocation(ing *extensions.Ingress, host, path string, backend *extensions.IngressBackend) {
+	if host == "" {
+		host = "_"
+	}
+	if path == "" {
+		path = "/"
+	}
+	if _, found := anns.locations[host+path]; !found {
+		anns.locations[host+path] = ing
+	}
+	for _, claim := range anns.claims[host+path] {
+		if claim.ingress == ing {
+			return
+		}
+	}
+	anns.claims[host+path] = append(anns.claims[host+path], &locationClaim{
+		ingress: ing,
+		backend: backend,
+	})
+}
+
+// location returns the annotations of the ingress which declares a location
+func (anns *ingressAnnotations) location(host, path string) map[string]string {
+	if ing, found := anns.locations[host+path]; found {
+		return trimAnnotations(ing.Annotations)
+	}
+	return nil
+}
+
+// locationIngress returns the ingress which declares a location
+func (anns *ingressAnnotations) locationIngress(host, path string) *extensions.Ingress {
+	return anns.locations[host+path]
+}
+
+// authSecret returns the <namespace>/<name> of the auth secret of a location,
+// the secret is read from the namespace of the ingress like the ingress core does
+func (anns *ingressAnnotations) authSecret(host, path string) string {
+	ing := anns.locationIngress(host, path)
+	if ing == nil {
+		return ""
+	}
+	name := trimAnnotations(ing.Annotations)["auth-secret"]
+	if name == "" {
+		return ""
+	}
+	return ing.Namespace + "/" + name
+}
+
+// locationClaims returns all the ingress resources which declare a location,
+// from the oldest to the newest one
+func (anns *ingressAnnotations) locationClaims(host, path string) []*locationClaim {
+	return anns.claims[host+path]
+}
+
+// namespace returns the namespace of the ingress which references a backend
+func (anns *ingressAnnotations) namespace(name string) string {
+	if ingBackend, found := anns.backends[name]; found {
+		return ingBackend.ingress.Namespace
+	}
+	return ""
+}
+
+// serviceName returns the name of the service of a backend
+func (anns *ingressAnnotations) serviceName(name string) string {
+	if ingBackend, found := anns.backends[name]; found {
+		return ingBackend.backend.ServiceName
+	}
+	return ""
+}
+
+func (anns *ingressAnnotations) backend(name string) map[string]string {
+	if ingBackend, found := anns.backends[name]; found {
+		return ingBackend.annotations
+	}
+	return nil
+}
+
+// notReadyEndpoints lists the endpoints of the service of a backend
+// which didn't report ready yet
+func (anns *ingressAnnotations) notReadyEndpoints(name string) []ingress.Endpoint {
+	ingBackend, found := anns.backends[name]
+	if !found {
+		return nil
+	}
+	return anns.serviceEndpoints(ingBackend.ingress.Namespace, ingBackend.backend.ServiceName, ingBackend.backend.ServicePort.String(), true)
+}
+
+// externalNameEndpoint returns the DNS name and port of the service of a backend
+// if it's an ExternalName service. The ingress core doesn't find endpoints of such
+// services, so the port should be declared on the ingress or on the service.
+func (anns *ingressAnnotations) externalNameEndpoint(name string) *ingress.Endpoint {
+	ingBackend, found := anns.backends[name]
+	if !found || anns.lister == nil {
+		return nil
+	}
+	svcKey := fmt.Sprintf("%v/%v", ingBackend.ingress.Namespace, ingBackend.backend.ServiceName)
+	svcObj, exists, err := anns.lister.Service.Indexer.GetByKey(svcKey)
+	if err != nil || !exists {
+		return nil
+	}
+	svc := svcObj.(*api.Service)
+	if svc.Spec.Type != api.ServiceTypeExternalName {
+		return nil
+	}
+	if !externalNameRegex.MatchString(svc.Spec.ExternalName) {
+		glog.Warningf("invalid external name of service %v: %v", svcKey, svc.Spec.ExternalName)
+		return nil
+	}
+	servicePort := ingBackend.backend.ServicePort
+	port := ""
+	if servicePort.Type == intstr.Int {
+		port = servicePort.String()
+	} else {
+		for _, svcPort := range svc.Spec.Ports {
+			if svcPort.Name == servicePort.StrVal {
+				port = strconv.Itoa(int(svcPort.Port))
+				break
+			}
+		}
+	}
+	if port == "" {
+		glog.Warningf("port %v was not found on service %v", servicePort.String(), svcKey)
+		return nil
+	}
+	return &ingress.Endpoint{
+		Address: svc.Spec.ExternalName,
+		Port:    port,
+	}
+}
+
+var externalNameRegex = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+
+// serviceEndpoints lists either the ready or the not ready endpoints of a service.
+// servicePort can be the port number, the target port or the name of the port.
+func (anns *ingressAnnotations) serviceEndpoints(namespace, serviceName, servicePort string, notReady bool) []ingress.Endpoint {
+	if anns.lister == nil {
+		return nil
+	}
+	svcKey := fmt.Sprintf("%v/%v", namespace, serviceName)
+	svcObj, exists, err := anns.lister.Service.Indexer.GetByKey(svcKey)
+	if err != nil || !exists {
+		glog.Warningf("service %v was not found: %v", svcKey, err)
+		return nil
+	}
+	svc := svcObj.(*api.Service)
+	var svcPort *api.ServicePort
+	for i := range svc.Spec.Ports {
+		port := &svc.Spec.Ports[i]
+		if strconv.Itoa(int(port.Port)) == servicePort || port.TargetPort.String() == servicePort || port.Name == servicePort {
+			svcPort = port
+			break
+		}
+	}
+	if svcPort == nil {
+		glog.Warningf("port %v was not found on service %v", servicePort, svcKey)
+		return nil
+	}
+	ep, err := anns.lister.Endpoint.GetServiceEndpoints(svc)
+	if err != nil {
+		return nil
+	}
+	endpoints := []ingress.Endpoint{}
+	for _, subset := range ep.Subsets {
+		addresses := subset.Addresses
+		if notReady {
+			addresses = subset.NotReadyAddresses
+		}
+		for _, epPort := range subset.Ports {
+			if epPort.Name != svcPort.Name || epPort.Protocol != api.ProtocolTCP {
+				continue
+			}
+			for _, addr := range addresses {
+				endpoints = append(endpoints, ingress.Endpoint{
+					Address: addr.IP,
+					Port:    strconv.Itoa(int(epPort.Port)),
+				})
+			}
+		}
+	}
+	return endpoints
+}
+
+// configMapValue reads a key from a ConfigMap, name should be <namespace>/<name>
+func (anns *ingressAnnotations) configMapValue(name, key string) (string, error) {
+	if anns.lister == nil {
+		return "", fmt.Errorf("configmap %v was not found", name)
+	}
+	obj, exists, err := anns.lister.ConfigMap.GetByKey(name)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("configmap %v was not found", name)
+	}
+	value, found := obj.(*api.ConfigMap).Data[key]
+	if !found {
+		return "", fmt.Errorf("key %v was not found on configmap %v", key, name)
+	}
+	return value, nil
+}
+
+// referencedObjects lists the cached secrets and configmaps, <namespace>/<name>,
+// referenced by ingress resources: TLS and auth secrets, and error pages
+func referencedObjects(lister *ingress.StoreLister) (secrets map[string]bool, configMaps map[string]bool) {
+	secrets = map[string]bool{}
+	configMaps = map[string]bool{}
+	addRef := func(refs map[string]bool, key string, exists bool, err error) {
+		if err == nil && exists {
+			refs[key] = true
+		}
+	}
+	for _, obj := range lister.Ingress.Store.List() {
+		ing, ok := obj.(*extensions.Ingress)
+		if !ok {
+			continue
+		}
+		var names []string
+		for _, tls := range ing.Spec.TLS {
+			names = append(names, tls.SecretName)
+		}
+		anns := trimAnnotations(ing.Annotations)
+		names = append(names, anns["auth-secret"], anns["auth-tls-secret"])
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			if !strings.Contains(name, "/") {
+				name = ing.Namespace + "/" + name
+			}
+			_, exists, err := lister.Secret.GetByKey(name)
+			addRef(secrets, name, exists, err)
+		}
+		if errorPage := strings.Split(anns["error-page-503"], "/"); len(errorPage) == 2 {
+			name := ing.Namespace + "/" + errorPage[0]
+			_, exists, err := lister.ConfigMap.GetByKey(name)
+			addRef(configMaps, name, exists, err)
+		}
+	}
+	return secrets, configMaps
+}
+
+// ingressByAge sorts ingress resources from the oldest to the newest one,
+// namespace and name are used if the creation timestamp is the same
+type ingressByAge []*extensions.Ingress
+
+func (ings ingressByAge) Len() int      { return len(ings) }
+func (ings ingressByAge) Swap(i, j int) { ings[i], ings[j] = ings[j], ings[i] }
+func (ings ingressByAge) Less(i, j int) bool {
+	ti := ings[i].CreationTimestamp
+	tj := ings[j].CreationTimestamp
+	if !ti.Equal(tj) {
+		return ti.Before(tj)
+	}
+	if ings[i].Namespace != ings[j].Namespace {
+		return ings[i].Namespace < ings[j].Namespace
+	}
+	return ings[i].Name < ings[j].Name
+}
+
+func trimAnnotations(annotations map[string]string) map[string]string {
+	data := map[string]string{}
+	for key, value := range annotations {
+		if strings.HasPrefix(key, annotationPrefix) {
+			data[strings.TrimPrefix(key, annotationPrefix)] = value
+		}
+	}
+	return data
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+)
+
+// startAPI serves HAProxy specific endpoints. The generic controller
+// owns the healthz port, so these endpoints use a port of its own.
+func (haproxy *haproxyController) startAPI() {
+	if haproxy.apiPort <= 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tables", haproxy.handleTables)
+	mux.HandleFunc("/tcp-services", haproxy.handleTCPServices)
+	mux.HandleFunc("/status", haproxy.handleStatus)
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%v", haproxy.apiPort),
+		Handler: mux,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		glog.Errorf("error serving the API on port %v: %v", haproxy.apiPort, err)
+	}
+}
+
+func (haproxy *haproxyController) handleTables(w http.ResponseWriter, r *http.Request) {
+	tables, err := readStickTables(haproxy.statsSocket, r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, tables)
+}
+
+func (haproxy *haproxyController) handleTCPServices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, haproxy.streams.list())
+}
+
+func (haproxy *haproxyController) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := haproxy.applied.status()
+	if status == nil {
+		http.Error(w, "configuration wasn't applied yet", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// applyStatus is the outcome of the last time a configuration was applied
+// to HAProxy, either reloading it or updating it through the stats socket
+type applyStatus struct {
+	Timestamp time.Time `json:"timestamp"`
+	Method    string    `json:"method"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration"`
+	Checksum  string    `json:"checksum"`
+}
+
+type statusTracker struct {
+	mutex sync.RWMutex
+	last  *applyStatus
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{}
+}
+
+func (t *statusTracker) record(method, checksum string, duration time.Duration, err error) {
+	status := &applyStatus{
+		Timestamp: time.Now(),
+		Method:    method,
+		Success:   err == nil,
+		Duration:  duration.String(),
+		Checksum:  checksum,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.last = status
+}
+
+// status returns a copy of the last apply status, nil if
+// a configuration wasn't applied yet
+func (t *statusTracker) status() *applyStatus {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.last == nil {
+		return nil
+	}
+	status := *t.last
+	return &status
+}
+
+// check fails if the last configuration couldn't be applied,
+// so HAProxy is probably running an outdated configuration
+func (t *statusTracker) check() error {
+	status := t.status()
+	if status != nil && !status.Success {
+		return fmt.Errorf("%v failed at %v: %v", status.Method, status.Timestamp.Format(time.RFC3339), status.Error)
+	}
+	return nil
+}
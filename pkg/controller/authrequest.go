@@ -0,0 +1,174 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/golang/glog"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// haproxyAuthRequest authenticates the requests of a location with a subrequest
+// to Path on a server of Backend, sent by the auth-request Lua action. Failed
+// requests are redirected to SignIn, or denied if SignIn is empty. The scheme,
+// host and URL of the request are appended to SignIn if SignInReturn is true.
+// Headers are copied from the auth response to the request. Responses are
+// cached by the credentials of the client for CacheTTL seconds, 0 disables.
+type haproxyAuthRequest struct {
+	Backend      string
+	Path         string
+	SignIn       string
+	SignInReturn bool
+	Headers      []authHeader
+	CacheTTL     int
+	HABackend    *haproxyAuthBackend
+}
+
+// authHeader is a header of the auth response, Var is the name
+// used by the auth-request Lua action to save its value
+type authHeader struct {
+	Name string
+	Var  string
+}
+
+// haproxyAuthBackend is the backend of the auth-url of a location, Resolve
+// means that Host is a DNS name, resolved by HAProxy
+type haproxyAuthBackend struct {
+	Name    string
+	Host    string
+	Port    string
+	Resolve bool
+}
+
+// authPathRegex restricts the path of the subrequest to characters
+// which don't need to be escaped on a request line
+var authPathRegex = regexp.MustCompile(`^/[A-Za-z0-9/_.~=&?%-]*$`)
+
+// authSignInRegex restricts the sign in URL to characters
+// which can be used in an unquoted redirect location, and
+// to the sample fetches of the log format, e.g. %[url]
+var authSignInRegex = regexp.MustCompile(`^(https?://[A-Za-z0-9.:-]+)?/[A-Za-z0-9/_.~=&?%(),\[\]-]*$`)
+
+var authSignInReturnRegex = regexp.MustCompile(`[?&]rd=`)
+
+// newHAProxyAuthURL reads the auth-url of a location, parsed by the ingress core,
+// and the auth-signin, auth-response-headers and auth-cache-ttl annotations.
+// Only http URLs are supported, the Lua action doesn't speak TLS.
+func newHAProxyAuthURL(hostname string, location *haproxyLocation, authURL string) *haproxyAuthRequest {
+	u, err := url.Parse(authURL)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		glog.Warningf("ignoring auth-url of %v%v, should be an http URL: %v", hostname, location.Path, authURL)
+		return nil
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = strings.Trim(u.Host, "[]"), "80"
+	}
+	path := u.RequestURI()
+	if !authPathRegex.MatchString(path) {
+		glog.Warningf("ignoring auth-url of %v%v, invalid path: %v", hostname, location.Path, path)
+		return nil
+	}
+	authBackend := &haproxyAuthBackend{
+		Name:    fmt.Sprintf("authurl-%x", sha1.Sum([]byte(u.Host)))[:18],
+		Host:    host,
+		Port:    port,
+		Resolve: net.ParseIP(host) == nil,
+	}
+	authRequest := &haproxyAuthRequest{
+		Backend:   authBackend.Name,
+		Path:      path,
+		Headers:   authHeaders(hostname, location.Path, location.AuthResponseHeaders),
+		HABackend: authBackend,
+	}
+	if location.AuthSignIn != "" {
+		if authSignInRegex.MatchString(location.AuthSignIn) {
+			authRequest.SignIn = location.AuthSignIn
+			// the return-to parameter is added unless the URL already has one
+			if !authSignInReturnRegex.MatchString(authRequest.SignIn) && !strings.Contains(authRequest.SignIn, "%[") {
+				if strings.Contains(authRequest.SignIn, "?") {
+					authRequest.SignIn += "&rd="
+				} else {
+					authRequest.SignIn += "?rd="
+				}
+				authRequest.SignInReturn = true
+			}
+		} else {
+			glog.Warningf("ignoring invalid auth-signin of %v%v: %v", hostname, location.Path, location.AuthSignIn)
+		}
+	}
+	if location.AuthCacheTTL != "" {
+		ttl, err := time.ParseDuration(location.AuthCacheTTL)
+		if err == nil && ttl >= time.Second {
+			authRequest.CacheTTL = int(ttl / time.Second)
+		} else {
+			glog.Warningf("ignoring invalid auth-cache-ttl of %v%v: %v", hostname, location.Path, location.AuthCacheTTL)
+		}
+	}
+	return authRequest
+}
+
+// authHeaders parses a comma-separated list of headers of the auth response
+func authHeaders(hostname, path, list string) []authHeader {
+	var headers []authHeader
+	for _, header := range splitList(list) {
+		if !headerNameRegex.MatchString(header) {
+			glog.Warningf("ignoring invalid auth response header of %v%v: %v", hostname, path, header)
+			continue
+		}
+		headers = append(headers, authHeader{
+			Name: header,
+			Var:  strings.Replace(strings.ToLower(header), "-", "_", -1),
+		})
+	}
+	return headers
+}
+
+// authBackends lists the backends of the auth-url of all the locations,
+// without duplicates
+func authBackends(serverLists ...[]*haproxyServer) []*haproxyAuthBackend {
+	backends := map[string]*haproxyAuthBackend{}
+	for _, servers := range serverLists {
+		for _, server := range servers {
+			if server == nil {
+				continue
+			}
+			for _, location := range server.Locations {
+				if location.HAAuthRequest != nil && location.HAAuthRequest.HABackend != nil {
+					backend := location.HAAuthRequest.HABackend
+					backends[backend.Name] = backend
+				}
+			}
+		}
+	}
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	authList := make([]*haproxyAuthBackend, len(names))
+	for i, name := range names {
+		authList[i] = backends[name]
+	}
+	return authList
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress"
+)
+
+// serverAuthTLS returns the CA file, read by the ingress core from the
+// auth-tls-secret annotation, used to verify the client certificates of a
+// hostname. Client certificates are verified by the TLS handshake, so the
+// same CA is used on all the paths of a hostname, and the CA of the first
+// location is used if the locations don't agree.
+func serverAuthTLS(server *ingress.Server) (caFile, checksum string) {
+	for _, location := range server.Locations {
+		cert := location.CertificateAuth.AuthSSLCert
+		if cert.CAFileName == "" {
+			continue
+		}
+		if caFile == "" {
+			caFile, checksum = cert.CAFileName, cert.PemSHA
+		} else if cert.CAFileName != caFile {
+			glog.Warningf("ignoring auth-tls-secret %v of %v%v, hostname already uses %v",
+				cert.Secret, server.Hostname, location.Path, caFile)
+		}
+	}
+	return caFile, checksum
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress"
+	"k8s.io/ingress/core/pkg/net/ssl"
+	"k8s.io/kubernetes/pkg/api"
+	"strings"
+)
+
+// bindCertificate is the default certificate of a destination IP,
+// used on requests without SNI or whose SNI doesn't match any hostname
+type bindCertificate struct {
+	IP             string
+	Name           string
+	SSLCertificate string
+	SSLPemChecksum string
+}
+
+var bindNameReplacer = strings.NewReplacer(".", "-", ":", "-")
+
+// newBindCertificates parses a comma-separated list of <ip>=<namespace>/<secret>
+// and saves the certificate and key of the secrets as PEM files
+func newBindCertificates(anns *ingressAnnotations, list string) []*bindCertificate {
+	certs := []*bindCertificate{}
+	for _, item := range splitList(list) {
+		bind := strings.Split(item, "=")
+		if len(bind) != 2 || strings.Count(bind[1], "/") != 1 {
+			glog.Warningf("invalid bind certificate format (ip=namespace/secret): %v", item)
+			continue
+		}
+		ip := strings.TrimSpace(bind[0])
+		name := bindNameReplacer.Replace(ip)
+		pem, err := secretPemFile(anns, "bind-"+name, strings.TrimSpace(bind[1]))
+		if err != nil {
+			glog.Warningf("error reading certificate of bind %v: %v", ip, err)
+			continue
+		}
+		certs = append(certs, &bindCertificate{
+			IP:             ip,
+			Name:           name,
+			SSLCertificate: pem.PemFileName,
+			SSLPemChecksum: pem.PemSHA,
+		})
+	}
+	return certs
+}
+
+// newDefaultCertificates parses a comma-separated list of <namespace>/<secret>
+// and saves the certificate and key of the secrets as PEM files. These certificates
+// are bound with the default one, so SNI can choose the best match.
+func newDefaultCertificates(anns *ingressAnnotations, list string) []*ingress.SSLCert {
+	certs := []*ingress.SSLCert{}
+	for _, secretName := range splitList(list) {
+		if strings.Count(secretName, "/") != 1 {
+			glog.Warningf("invalid default certificate format (namespace/secret): %v", secretName)
+			continue
+		}
+		pem, err := secretPemFile(anns, "default-"+strings.Replace(secretName, "/", "-", 1), secretName)
+		if err != nil {
+			glog.Warningf("error reading default certificate %v: %v", secretName, err)
+			continue
+		}
+		certs = append(certs, pem)
+	}
+	return certs
+}
+
+// wildcardCertificate is a TLS secret of an ingress resource
+// whose certificate has at least one wildcard hostname
+type wildcardCertificate struct {
+	secretName string
+	domains    []string
+}
+
+// assignWildcardCertificates adds a certificate to servers without one, if a wildcard
+// certificate used by any ingress resource covers its hostname. Such servers would
+// otherwise be served only via plain HTTP.
+func assignWildcardCertificates(anns *ingressAnnotations, servers []*ingress.Server) {
+	wildcards := newWildcardCertificates(anns)
+	if len(wildcards) == 0 {
+		return
+	}
+	pems := map[string]*ingress.SSLCert{}
+	for _, server := range servers {
+		if server.Hostname == "_" || server.SSLCertificate != "" {
+			continue
+		}
+		for _, wildcard := range wildcards {
+			if !wildcard.matches(server.Hostname) {
+				continue
+			}
+			cert, found := pems[wildcard.secretName]
+			if !found {
+				var err error
+				cert, err = secretPemFile(anns, "wildcard-"+strings.Replace(wildcard.secretName, "/", "-", 1), wildcard.secretName)
+				if err != nil {
+					glog.Warningf("error reading wildcard certificate %v: %v", wildcard.secretName, err)
+				}
+				pems[wildcard.secretName] = cert
+			}
+			if cert != nil {
+				glog.V(2).Infof("using wildcard certificate %v on host %v", wildcard.secretName, server.Hostname)
+				server.SSLCertificate = cert.PemFileName
+				server.SSLPemChecksum = cert.PemSHA
+				break
+			}
+		}
+	}
+}
+
+// newWildcardCertificates reads the TLS secrets of the ingress resources,
+// from the oldest to the newest one, whose certificates have wildcard hostnames
+func newWildcardCertificates(anns *ingressAnnotations) []*wildcardCertificate {
+	wildcards := []*wildcardCertificate{}
+	added := map[string]bool{}
+	for _, ing := range anns.ingresses {
+		for _, tls := range ing.Spec.TLS {
+			secretName := ing.Namespace + "/" + tls.SecretName
+			if tls.SecretName == "" || added[secretName] {
+				continue
+			}
+			added[secretName] = true
+			domains := secretWildcardDomains(anns, secretName)
+			if len(domains) > 0 {
+				wildcards = append(wildcards, &wildcardCertificate{
+					secretName: secretName,
+					domains:    domains,
+				})
+			}
+		}
+	}
+	return wildcards
+}
+
+// secretWildcardDomains returns the domains covered by the wildcard hostnames
+// of the certificate of a secret, e.g. `.example.com` for `*.example.com`
+func secretWildcardDomains(anns *ingressAnnotations, secretName string) []string {
+	obj, exists, err := anns.lister.Secret.GetByKey(secretName)
+	if err != nil || !exists {
+		return nil
+	}
+	block, _ := pem.Decode(obj.(*api.Secret).Data[api.TLSCertKey])
+	if block == nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	names := cert.DNSNames
+	if len(names) == 0 {
+		names = []string{cert.Subject.CommonName}
+	}
+	domains := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "*.") {
+			domains = append(domains, strings.ToLower(name[1:]))
+		}
+	}
+	return domains
+}
+
+// matches checks if hostname is covered by the certificate, a wildcard
+// matches only one label, so `*.example.com` doesn't match `a.b.example.com`
+func (w *wildcardCertificate) matches(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+	for _, domain := range w.domains {
+		if strings.HasSuffix(hostname, domain) {
+			label := hostname[:len(hostname)-len(domain)]
+			if label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// secretPemFile saves the tls.crt and tls.key of a secret, <namespace>/<name>,
+// as a PEM file in the SSL directory of the ingress core
+func secretPemFile(anns *ingressAnnotations, pemName, secretName string) (*ingress.SSLCert, error) {
+	if anns.lister == nil {
+		return nil, fmt.Errorf("secret %v was not found", secretName)
+	}
+	obj, exists, err := anns.lister.Secret.GetByKey(secretName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("secret %v was not found", secretName)
+	}
+	secret := obj.(*api.Secret)
+	cert, okcert := secret.Data[api.TLSCertKey]
+	key, okkey := secret.Data[api.TLSPrivateKeyKey]
+	if !okcert || !okkey {
+		return nil, fmt.Errorf("secret %v should have %v and %v", secretName, api.TLSCertKey, api.TLSPrivateKeyKey)
+	}
+	return ssl.AddOrUpdateCertAndKey(pemName, cert, key, []byte{})
+}
+
+// secretCAFile saves the ca.crt of a secret, <namespace>/<name>,
+// as a PEM file in the SSL directory of the ingress core
+func secretCAFile(anns *ingressAnnotations, caName, secretName string) (*ingress.SSLCert, error) {
+	if anns.lister == nil {
+		return nil, fmt.Errorf("secret %v was not found", secretName)
+	}
+	obj, exists, err := anns.lister.Secret.GetByKey(secretName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("secret %v was not found", secretName)
+	}
+	ca, found := obj.(*api.Secret).Data["ca.crt"]
+	if !found {
+		return nil, fmt.Errorf("secret %v should have ca.crt", secretName)
+	}
+	return ssl.AddCertAuth(caName, ca)
+}
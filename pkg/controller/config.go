@@ -18,26 +18,130 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
 	"github.com/golang/glog"
 	"github.com/mitchellh/mapstructure"
+	"io"
 	"k8s.io/ingress/core/pkg/ingress"
 	"k8s.io/ingress/core/pkg/ingress/annotations/rewrite"
 	"k8s.io/ingress/core/pkg/ingress/defaults"
-	"os"
+	"k8s.io/kubernetes/pkg/api"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type (
 	configuration struct {
-		Userlists           map[string]userlist
-		Backends            []*ingress.Backend
-		DefaultServer       *haproxyServer
-		HTTPServers         []*haproxyServer
-		HTTPSServers        []*haproxyServer
-		TCPEndpoints        []ingress.L4Service
-		UDPEndpoints        []ingress.L4Service
-		PassthroughBackends []*ingress.SSLPassthroughBackend
-		Syslog              string `json:"syslog-endpoint"`
+		Userlists               map[string]userlist
+		HAUserlists             []userlist
+		Backends                []*haproxyBackend
+		DefaultServer           *haproxyServer
+		HTTPServers             []*haproxyServer
+		HTTPSServers            []*haproxyServer
+		TCPEndpoints            []ingress.L4Service
+		UDPEndpoints            []ingress.L4Service
+		PassthroughBackends     []*ingress.SSLPassthroughBackend
+		Syslog                  string `json:"syslog-endpoint"`
+		SyslogFacility          string `json:"syslog-facility"`
+		SyslogLevel             string `json:"syslog-level"`
+		SyslogLength            int    `json:"syslog-length"`
+		SyslogFormat            string `json:"syslog-format"`
+		SyslogErrors            string `json:"syslog-errors-endpoint"`
+		SyslogErrorsFacility    string `json:"syslog-errors-facility"`
+		SyslogErrorsStatus      int    `json:"syslog-errors-status"`
+		ConnRateLimit           int    `json:"rate-limit-connections"`
+		ConnRateLimitSource     int    `json:"rate-limit-connections-source"`
+		HTTPNoDelay             bool   `json:"http-no-delay"`
+		SpliceAuto              bool   `json:"splice-auto"`
+		DontLogNull             bool   `json:"dontlognull"`
+		DontLogNormal           bool   `json:"dontlog-normal"`
+		LogSamplePercent        int    `json:"log-sample-percent"`
+		CaptureReqHeaders       string `json:"capture-request-headers"`
+		HACaptureReqHeaders     []string
+		HACanaryCookie          bool
+		CaptureCookie           string `json:"capture-cookie"`
+		BindDefaultCerts        string `json:"bind-default-certificates"`
+		HABindCerts             []*bindCertificate
+		DefaultCerts            string `json:"default-certificates"`
+		HADefaultCerts          []*ingress.SSLCert
+		WildcardCerts           bool   `json:"wildcard-certificates"`
+		Frontends               string `json:"frontends"`
+		HAFrontends             []*haproxyFrontend
+		SSLCiphers              string `json:"ssl-ciphers"`
+		SSLCipherSuites         string `json:"ssl-cipher-suites"`
+		SSLOptions              string `json:"ssl-options"`
+		SSLCrtList              bool   `json:"ssl-crt-list"`
+		HTTP2                   bool   `json:"http2"`
+		HAHTTPSFrontends        []*haproxyHTTPSFrontend
+		HAAcmePort              int
+		TimeoutHTTPRequest      string `json:"timeout-http-request"`
+		TimeoutConnect          string `json:"timeout-connect"`
+		TimeoutClient           string `json:"timeout-client"`
+		TimeoutClientFin        string `json:"timeout-client-fin"`
+		TimeoutServer           string `json:"timeout-server"`
+		TimeoutTunnel           string `json:"timeout-tunnel"`
+		ProxyProtocol           string `json:"proxy-protocol"`
+		HASendProxy             string
+		TimeoutKeepAlive        string `json:"timeout-keep-alive"`
+		DenyStatus              int    `json:"whitelist-deny-status"`
+		DenyPage                string `json:"whitelist-deny-page"`
+		HADenyErrorFile         string
+		HADenyErrorFileChecksum string
+		HARateLimits            []*haproxyRateLimit
+		HACORSBackends          []*haproxyCORS
+		HAAuthRequest           bool
+		HAAuthBackends          []*haproxyAuthBackend
+		AuthLDAPAgent           string `json:"auth-ldap-agent"`
+		HAAuthLDAP              bool
+		ConfigGlobal            string `json:"config-global"`
+		HAConfigGlobal          []string
+		ConfigDefaults          string `json:"config-defaults"`
+		HAConfigDefaults        []string
+		ConfigFrontend          string `json:"config-frontend"`
+		HAConfigFrontend        []string
+		HANameservers           []string
+		HTTPLogFormat           string `json:"http-log-format"`
+		HAHTTPLogFormat         string
+		HAHTTPLogJSON           bool
+		TCPLogFormat            string `json:"tcp-log-format"`
+		HATCPLogFormat          string
+		UniqueIDFormat          string `json:"unique-id-format"`
+		HAUniqueIDFormat        string
+		UniqueIDHeader          string `json:"unique-id-header"`
+		TraceHeaders            string `json:"trace-headers"`
+		LogIngress              bool   `json:"log-ingress"`
+		StatsPort               int    `json:"stats-port"`
+		StatsAuthSecret         string `json:"stats-auth-secret"`
+		HAStatsAuth             bool
+		StatsSourceRange        string `json:"stats-source-range"`
+		HAStatsSourceRange      string
+		WhitelistSourceRange    string `json:"whitelist-source-range"`
+		HAWhitelist             string
+		BlacklistSourceRange    string `json:"blacklist-source-range"`
+		HABlacklist             string
+		BindIPAddrHTTP          string `json:"bind-ip-addr-http"`
+		BindIPAddrHTTPS         string `json:"bind-ip-addr-https"`
+		HTTPPort                int    `json:"http-port"`
+		HTTPSPort               int    `json:"https-port"`
+		BindHTTPExtra           string `json:"bind-http-extra"`
+		BindHTTPSExtra          string `json:"bind-https-extra"`
+		HABindHTTP              []string
+		HABindHTTPS             []string
+		UseProxyProtocol        bool `json:"use-proxy-protocol"`
+		HAAcceptProxyHTTP       bool
+		HAAcceptProxyHTTPS      bool
+		HAAcceptProxyTCP        bool
+		TCPSNIServices          string `json:"tcp-sni-services"`
+		HATCPSNIFrontends       []*haproxyTCPSNIFrontend
+		HATCPBackends           []*haproxyTCPBackend
+		HASSLPassthrough        []*haproxySSLPassthrough
+		HATCPServiceOptions     map[int]*tcpServiceOptions
 	}
 	userlist struct {
 		ListName string
@@ -49,6 +153,75 @@ type (
 		Password  string
 		Encrypted bool
 	}
+	// haproxyBackend adds to ingress.Backend the HAProxy specific options.
+	// Options are read from ConfigMap and overridden by ingress annotations.
+	haproxyBackend struct {
+		*ingress.Backend
+		backendConfig
+		HAEndpoints            []*haproxyEndpoint
+		MaxConnServer          int
+		HAErrorFile503         string
+		HAErrorFile503Checksum string
+		HASlots                []*haproxySlot
+		HASendProxy            string
+		HARewrites             []*haproxyRewrite
+		HAConfigBackend        []string
+		HACheckParams          string
+		HAAgentCheck           string
+		HAExternalName         bool
+		HASecureCAFile         string
+		HASecureCAChecksum     string
+	}
+	// haproxySlot is a server of a backend using dynamic scaling,
+	// Endpoint is nil on empty slots
+	haproxySlot struct {
+		Name     string
+		Endpoint *haproxyEndpoint
+	}
+	haproxyEndpoint struct {
+		ingress.Endpoint
+		Backup bool
+		Weight int
+	}
+	backendConfig struct {
+		RateLimitSessions int    `json:"rate-limit-sessions"`
+		MaxConnBackend    int    `json:"maxconn-backend"`
+		ServerMaxConn     int    `json:"maxconn-server"`
+		MaxQueueServer    int    `json:"maxqueue-server"`
+		FullConn          int    `json:"fullconn"`
+		MinConn           int    `json:"minconn"`
+		HealthCheck       bool   `json:"health-check"`
+		HealthCheckURI    string `json:"health-check-uri"`
+		HealthCheckInter  string `json:"health-check-interval"`
+		HealthCheckRise   int    `json:"health-check-rise-count"`
+		HealthCheckFall   int    `json:"health-check-fall-count"`
+		NotReadyEndpoints string `json:"not-ready-endpoints"`
+		BackupService     string `json:"backup-service"`
+		ErrorPage503      string `json:"error-page-503"`
+		BackendSNI        string `json:"backend-sni"`
+		DynamicScaling    bool   `json:"dynamic-scaling"`
+		SlotsIncrement    int    `json:"backend-server-slots-increment"`
+		BalanceAlgorithm  string `json:"balance-algorithm"`
+		TimeoutConnect    string `json:"timeout-connect"`
+		TimeoutServer     string `json:"timeout-server"`
+		TimeoutTunnel     string `json:"timeout-tunnel"`
+		ProxyProtocol     string `json:"proxy-protocol"`
+		ConfigBackend     string `json:"config-backend"`
+		SlowStart         string `json:"slowstart"`
+		AgentCheckPort    int    `json:"agent-check-port"`
+		AgentCheckAddr    string `json:"agent-check-addr"`
+		AgentCheckInter   string `json:"agent-check-interval"`
+		SecureVerifyCA    string `json:"secure-verify-ca-secret"`
+		HTTPReuse         string `json:"http-reuse"`
+	}
+	// haproxyFrontend is a named tcp mode frontend with its own bind,
+	// which routes only to the hostnames assigned to it
+	haproxyFrontend struct {
+		Name       string
+		Bind       string
+		Servers    []*haproxyServer
+		namespaces map[string]bool
+	}
 	// haproxyServer and haproxyLocation build some missing pieces
 	// from ingress.Server used by HAProxy
 	haproxyServer struct {
@@ -59,15 +232,76 @@ type (
 		RootLocation    *haproxyLocation   `json:"defaultLocation"`
 		Locations       []*haproxyLocation `json:"locations,omitempty"`
 		SSLRedirect     bool               `json:"sslRedirect"`
+		HACanaryCookie  bool               `json:"canaryCookie"`
+		HAFrontend      string             `json:"frontend,omitempty"`
+		HTTP2           bool               `json:"http2"`
+		HAAppRoot       string             `json:"appRoot,omitempty"`
+		HACAFile        string             `json:"caFile,omitempty"`
+		HACAChecksum    string             `json:"caChecksum,omitempty"`
+		HACAOptional    bool               `json:"caOptional,omitempty"`
+		HASSLCiphers    string             `json:"sslCiphers,omitempty"`
+		HACrtList       bool               `json:"crtList,omitempty"`
+		HAMatchSNI      string             `json:"matchSNI,omitempty"`
 	}
 	haproxyLocation struct {
-		IsRootLocation bool             `json:"isDefaultLocation"`
-		Path           string           `json:"path"`
-		Backend        string           `json:"backend"`
-		Redirect       rewrite.Redirect `json:"redirect,omitempty"`
-		Userlist       userlist         `json:"userlist,omitempty"`
-		HAMatchPath    string           `json:"haMatchPath"`
-		HAWhitelist    string           `json:"whitelist,omitempty"`
+		locationConfig
+		IsRootLocation bool                `json:"isDefaultLocation"`
+		Path           string              `json:"path"`
+		Backend        string              `json:"backend"`
+		Redirect       rewrite.Redirect    `json:"redirect,omitempty"`
+		Userlist       userlist            `json:"userlist,omitempty"`
+		HAMatchPath    string              `json:"haMatchPath"`
+		HAMatchHTTPS   string              `json:"haMatchHTTPS"`
+		HAWhitelist    string              `json:"whitelist,omitempty"`
+		HAAuthDenied   bool                `json:"authDenied,omitempty"`
+		HAAuthLDAP     bool                `json:"authLDAP,omitempty"`
+		HAAuthTLS      bool                `json:"authTLS,omitempty"`
+		HABlacklist    string              `json:"blacklist,omitempty"`
+		HAFailover     string              `json:"failover,omitempty"`
+		HACanary       string              `json:"canary,omitempty"`
+		HACanaryMatch  []string            `json:"canaryMatch,omitempty"`
+		HARateLimit    *haproxyRateLimit   `json:"rateLimit,omitempty"`
+		HACORS         *haproxyCORS        `json:"cors,omitempty"`
+		HAAuthRequest  *haproxyAuthRequest `json:"authRequest,omitempty"`
+		HANamespace    string              `json:"namespace,omitempty"`
+		HAIngress      string              `json:"ingress,omitempty"`
+		HAService      string              `json:"service,omitempty"`
+	}
+	// locationConfig has the HAProxy specific options of a location,
+	// read from the annotations of the ingress which declares it
+	locationConfig struct {
+		FailoverService      string `json:"failover-service"`
+		CanaryService        string `json:"canary-service"`
+		CanaryByHeader       string `json:"canary-by-header"`
+		CanaryHeaderValue    string `json:"canary-by-header-value"`
+		CanaryByCookie       string `json:"canary-by-cookie"`
+		CanaryWeight         int    `json:"canary-weight"`
+		CanaryStickyCookie   string `json:"canary-sticky-cookie"`
+		Frontend             string `json:"frontend"`
+		HTTP2                string `json:"http2"`
+		SSLCiphers           string `json:"ssl-ciphers"`
+		AppRoot              string `json:"app-root"`
+		BlacklistSourceRange string `json:"blacklist-source-range"`
+		RateLimitRPS         int    `json:"rate-limit-rps"`
+		RateLimitRPM         int    `json:"rate-limit-rpm"`
+		RateLimitBurst       int    `json:"rate-limit-burst"`
+		RateLimitKey         string `json:"rate-limit-key"`
+		CORSAllowOrigin      string `json:"cors-allow-origin"`
+		CORSAllowMethods     string `json:"cors-allow-methods"`
+		CORSAllowHeaders     string `json:"cors-allow-headers"`
+		CORSAllowCredentials bool   `json:"cors-allow-credentials"`
+		CORSMaxAge           int    `json:"cors-max-age"`
+		OAuth                string `json:"oauth"`
+		OAuthURIPrefix       string `json:"oauth-uri-prefix"`
+		OAuthHeaders         string `json:"oauth-headers"`
+		AuthSignIn           string `json:"auth-signin"`
+		AuthResponseHeaders  string `json:"auth-response-headers"`
+		AuthCacheTTL         string `json:"auth-cache-ttl"`
+		AuthType             string `json:"auth-type"`
+		AuthRealm            string `json:"auth-realm"`
+		AuthTLSHeaders       bool   `json:"auth-tls-headers"`
+		AuthTLSCertHeader    bool   `json:"auth-tls-cert-header"`
+		AuthTLSVerifyClient  string `json:"auth-tls-verify-client"`
 	}
 )
 
@@ -90,28 +324,891 @@ func mergeMap(data map[string]string, resultTo interface{}) error {
 	return nil
 }
 
-func newConfig(cfg *ingress.Configuration, data map[string]string) *configuration {
-	userlists := newUserlists(cfg.Servers)
-	haHTTPServers, haHTTPSServers, haDefaultServer := newHAProxyServers(userlists, cfg.Servers)
+func newConfig(cfg *ingress.Configuration, data map[string]string, anns *ingressAnnotations) *configuration {
+	def := newBackendDefaults(data)
+	applyConflictPolicy(cfg, anns, data["conflict-policy"], def)
 	conf := configuration{
-		Userlists:           userlists,
-		Backends:            cfg.Backends,
-		HTTPServers:         haHTTPServers,
-		HTTPSServers:        haHTTPSServers,
-		DefaultServer:       haDefaultServer,
-		TCPEndpoints:        cfg.TCPEndpoints,
-		UDPEndpoints:        cfg.UDPEndpoints,
-		PassthroughBackends: cfg.PassthroughBackends,
+		DontLogNull:          true,
+		LogSamplePercent:     100,
+		SyslogFacility:       "local0",
+		SyslogFormat:         "rfc5424",
+		SyslogErrorsFacility: "local1",
+		SyslogErrorsStatus:   500,
+		SSLCiphers:           defaultSSLCiphers,
+		SSLOptions:           "no-tls-tickets",
+		TimeoutHTTPRequest:   "5s",
+		TimeoutConnect:       "5s",
+		TimeoutClient:        "50s",
+		TimeoutClientFin:     "50s",
+		TimeoutServer:        "50s",
+		TimeoutTunnel:        "1h",
+		TimeoutKeepAlive:     "60s",
+		DenyStatus:           403,
+		UniqueIDFormat:       "%{+X}o %ci:%cp_%fi:%fp_%Ts_%rt:%pid",
+		BindIPAddrHTTP:       "*",
+		BindIPAddrHTTPS:      "*",
+		HTTPPort:             80,
+		HTTPSPort:            443,
 	}
+	defaultTimeouts := []string{conf.TimeoutHTTPRequest, conf.TimeoutConnect, conf.TimeoutClient,
+		conf.TimeoutClientFin, conf.TimeoutServer, conf.TimeoutTunnel, conf.TimeoutKeepAlive}
 	mergeMap(data, &conf)
+	if conf.WildcardCerts {
+		assignWildcardCertificates(anns, cfg.Servers)
+	}
+	conf.Userlists = newUserlists(anns, cfg.Servers)
+	haHTTPServers, haHTTPSServers, haDefaultServer := newHAProxyServers(conf.Userlists, anns, cfg.Servers)
+	haBackends := newHAProxyBackends(anns, cfg.Backends, data)
+	haBackends = append(haBackends, newServiceBackends(anns, data, haBackends, haHTTPServers, haHTTPSServers)...)
+	assignRewrites(haBackends, haHTTPServers, haHTTPSServers, []*haproxyServer{haDefaultServer})
+	conf.Backends = haBackends
+	conf.HTTPServers = haHTTPServers
+	conf.HTTPSServers = haHTTPSServers
+	conf.DefaultServer = haDefaultServer
+	conf.TCPEndpoints = cfg.TCPEndpoints
+	conf.UDPEndpoints = cfg.UDPEndpoints
+	conf.PassthroughBackends = cfg.PassthroughBackends
+	for i, timeout := range []*string{&conf.TimeoutHTTPRequest, &conf.TimeoutConnect, &conf.TimeoutClient,
+		&conf.TimeoutClientFin, &conf.TimeoutServer, &conf.TimeoutTunnel, &conf.TimeoutKeepAlive} {
+		if !validTimeout(*timeout) {
+			glog.Warningf("invalid timeout, using %v: %v", defaultTimeouts[i], *timeout)
+			*timeout = defaultTimeouts[i]
+		}
+	}
+	for _, facility := range []struct {
+		name  string
+		value *string
+		def   string
+	}{
+		{"syslog-facility", &conf.SyslogFacility, "local0"},
+		{"syslog-errors-facility", &conf.SyslogErrorsFacility, "local1"},
+	} {
+		if !syslogFacilityRegex.MatchString(*facility.value) {
+			glog.Warningf("invalid %v, using %v: %v", facility.name, facility.def, *facility.value)
+			*facility.value = facility.def
+		}
+	}
+	if conf.SyslogLevel != "" && !syslogLevelRegex.MatchString(conf.SyslogLevel) {
+		glog.Warningf("ignoring invalid syslog level: %v", conf.SyslogLevel)
+		conf.SyslogLevel = ""
+	}
+	if conf.SyslogLength != 0 && (conf.SyslogLength < 80 || conf.SyslogLength > 65535) {
+		glog.Warningf("ignoring invalid syslog length, should be between 80 and 65535: %v", conf.SyslogLength)
+		conf.SyslogLength = 0
+	}
+	if conf.SyslogFormat != "rfc5424" && conf.SyslogFormat != "rfc3164" {
+		glog.Warningf("invalid syslog format, using rfc5424: %v", conf.SyslogFormat)
+		conf.SyslogFormat = "rfc5424"
+	}
+	if conf.LogSamplePercent < 0 {
+		glog.Warningf("invalid log sample percent, using 0: %v", conf.LogSamplePercent)
+		conf.LogSamplePercent = 0
+	} else if conf.LogSamplePercent > 100 {
+		glog.Warningf("invalid log sample percent, using 100: %v", conf.LogSamplePercent)
+		conf.LogSamplePercent = 100
+	}
+	if conf.SyslogErrorsStatus != 400 && conf.SyslogErrorsStatus != 500 {
+		glog.Warningf("invalid syslog errors status, using 500: %v", conf.SyslogErrorsStatus)
+		conf.SyslogErrorsStatus = 500
+	}
+	conf.HACaptureReqHeaders = splitList(conf.CaptureReqHeaders)
+	if conf.UniqueIDHeader != "" && !headerNameRegex.MatchString(conf.UniqueIDHeader) {
+		glog.Warningf("ignoring invalid unique id header: %v", conf.UniqueIDHeader)
+		conf.UniqueIDHeader = ""
+	}
+	if conf.UniqueIDHeader != "" {
+		conf.HAUniqueIDFormat = logFormat("unique-id-format", conf.UniqueIDFormat)
+		if conf.HAUniqueIDFormat == "" {
+			conf.UniqueIDHeader = ""
+		}
+	}
+	if conf.TraceHeaders != "" && conf.TraceHeaders != "w3c" && conf.TraceHeaders != "b3" {
+		glog.Warningf("ignoring invalid trace headers, should be w3c or b3: %v", conf.TraceHeaders)
+		conf.TraceHeaders = ""
+	}
+	// request and trace IDs are added to the end of the default and json formats
+	var logFields, jsonLogFields string
+	if conf.UniqueIDHeader != "" {
+		logFields += " %ID"
+		jsonLogFields += `,"request_id":%{+Q}ID`
+	}
+	if conf.TraceHeaders != "" {
+		logFields += " %[var(txn.trace_id)]"
+		jsonLogFields += `,"trace_id":%{+Q}[var(txn.trace_id)]`
+	}
+	if conf.Syslog == "" {
+		// the ingress vars are only used on the access logs
+		conf.LogIngress = false
+	}
+	if conf.LogIngress {
+		logFields += " %[var(txn.namespace)]/%[var(txn.ingress)] %[var(txn.service)]"
+		jsonLogFields += `,"namespace":%{+Q}[var(txn.namespace)],"ingress":%{+Q}[var(txn.ingress)],"service":%{+Q}[var(txn.service)]`
+	}
+	conf.HAHTTPLogJSON = conf.HTTPLogFormat == "json"
+	switch {
+	case conf.HAHTTPLogJSON:
+		conf.HTTPLogFormat = strings.TrimSuffix(httpLogFormatJSON, "}") + jsonLogFields + "}"
+	case conf.HTTPLogFormat == "" && logFields != "":
+		// option httplog doesn't log the request and trace IDs
+		conf.HTTPLogFormat = httpLogFormatDefault + logFields
+	}
+	if conf.TCPLogFormat == "json" {
+		conf.TCPLogFormat = tcpLogFormatJSON
+	}
+	conf.HAHTTPLogFormat = logFormat("http-log-format", conf.HTTPLogFormat)
+	conf.HATCPLogFormat = logFormat("tcp-log-format", conf.TCPLogFormat)
+	for _, snippet := range []struct {
+		name   string
+		config string
+		lines  *[]string
+	}{
+		{"config-global", conf.ConfigGlobal, &conf.HAConfigGlobal},
+		{"config-defaults", conf.ConfigDefaults, &conf.HAConfigDefaults},
+		{"config-frontend", conf.ConfigFrontend, &conf.HAConfigFrontend},
+	} {
+		lines, err := configSnippet(snippet.config)
+		if err != nil {
+			glog.Warningf("ignoring %v snippet: %v", snippet.name, err)
+		}
+		*snippet.lines = lines
+	}
+	if !errorFileStatus[conf.DenyStatus] {
+		glog.Warningf("unsupported whitelist deny status, using 403: %v", conf.DenyStatus)
+		conf.DenyStatus = 403
+	}
+	if conf.DenyPage != "" {
+		conf.HADenyErrorFile, conf.HADenyErrorFileChecksum = denyErrorFile(anns, conf.DenyPage, conf.DenyStatus)
+	}
+	if conf.StatsPort < 0 || conf.StatsPort > 65535 {
+		glog.Warningf("invalid stats port, disabling the stats page: %v", conf.StatsPort)
+		conf.StatsPort = 0
+	}
+	if conf.StatsAuthSecret != "" {
+		if users, err := statsUserlist(anns, conf.StatsAuthSecret); err != nil {
+			// an unprotected stats page isn't an option if auth was asked
+			glog.Warningf("disabling stats page: %v", err)
+			conf.StatsPort = 0
+		} else {
+			conf.Userlists[statsUserlistName] = *users
+			conf.HAStatsAuth = true
+		}
+	}
+	if conf.StatsSourceRange != "" {
+		conf.HAStatsSourceRange = sourceRange("stats source range", conf.StatsSourceRange)
+		if conf.HAStatsSourceRange == "" {
+			glog.Warningf("disabling stats page, stats source range doesn't have valid addresses: %v", conf.StatsSourceRange)
+			conf.StatsPort = 0
+		}
+	}
+	if conf.WhitelistSourceRange != "" {
+		conf.HAWhitelist = sourceRange("whitelist source range", conf.WhitelistSourceRange)
+		if conf.HAWhitelist == "" {
+			// a typo shouldn't open the cluster to any address,
+			// 0.0.0.0 isn't a valid source so every request is denied
+			glog.Warningf("denying all requests, whitelist source range doesn't have valid addresses: %v", conf.WhitelistSourceRange)
+			conf.HAWhitelist = " 0.0.0.0/32"
+		}
+	}
+	conf.HABlacklist = sourceRange("blacklist source range", conf.BlacklistSourceRange)
+	conf.HAAcceptProxyHTTP = acceptProxy(data, "use-proxy-protocol-http", conf.UseProxyProtocol)
+	conf.HAAcceptProxyHTTPS = acceptProxy(data, "use-proxy-protocol-https", conf.UseProxyProtocol)
+	conf.HAAcceptProxyTCP = acceptProxy(data, "use-proxy-protocol-tcp", conf.UseProxyProtocol)
+	for _, bind := range []struct {
+		name string
+		port *int
+		def  int
+	}{
+		{"http port", &conf.HTTPPort, 80},
+		{"https port", &conf.HTTPSPort, 443},
+	} {
+		if *bind.port <= 0 || *bind.port > 65535 {
+			glog.Warningf("invalid %v, using %v: %v", bind.name, bind.def, *bind.port)
+			*bind.port = bind.def
+		}
+	}
+	if conf.HTTPPort == conf.HTTPSPort {
+		glog.Warningf("http and https ports should be distinct, using 80 and 443: %v", conf.HTTPPort)
+		conf.HTTPPort, conf.HTTPSPort = 80, 443
+	}
+	usedPorts := map[int]bool{conf.HTTPPort: true, conf.HTTPSPort: true}
+	conf.HABindHTTP = newBinds("http", conf.BindIPAddrHTTP, conf.HTTPPort, conf.BindHTTPExtra, usedPorts)
+	conf.HABindHTTPS = newBinds("https", conf.BindIPAddrHTTPS, conf.HTTPSPort, conf.BindHTTPSExtra, usedPorts)
+	tcpEndpoints := make([]ingress.L4Service, 0, len(conf.TCPEndpoints))
+	for _, tcp := range conf.TCPEndpoints {
+		if usedPorts[tcp.Port] {
+			glog.Warningf("ignoring TCP service %v/%v, port %v is used by the http or https frontend", tcp.Backend.Namespace, tcp.Backend.Name, tcp.Port)
+			continue
+		}
+		tcpEndpoints = append(tcpEndpoints, tcp)
+	}
+	conf.TCPEndpoints = tcpEndpoints
+	if conf.TCPSNIServices != "" {
+		usedPorts[conf.StatsPort] = true
+		for _, tcp := range conf.TCPEndpoints {
+			usedPorts[tcp.Port] = true
+		}
+		conf.HATCPSNIFrontends, conf.HATCPBackends = newTCPSNIServices(anns, conf.TCPSNIServices, usedPorts)
+	}
+	conf.HAUserlists = uniqueUserlists(conf.Userlists)
+	conf.HABindCerts = newBindCertificates(anns, conf.BindDefaultCerts)
+	conf.HADefaultCerts = newDefaultCertificates(anns, conf.DefaultCerts)
+	conf.HAFrontends = newHAProxyFrontends(conf.Frontends, anns, haHTTPSServers)
+	conf.HASSLPassthrough, conf.HATCPBackends = newSSLPassthrough(cfg, anns, conf.HAFrontends, haHTTPServers, conf.HATCPBackends)
+	assignHTTP2(conf.HTTP2, haHTTPSServers)
+	assignSSLCiphers(haHTTPSServers)
+	conf.HAHTTPSFrontends = newHTTPSFrontends(conf.SSLCrtList, haHTTPSServers)
+	conf.HARateLimits = rateLimitTables(haHTTPServers, haHTTPSServers)
+	conf.HACORSBackends = corsBackends(haHTTPServers, haHTTPSServers)
+	conf.HAAuthBackends = authBackends(haHTTPServers, haHTTPSServers)
+	for _, backend := range haBackends {
+		if backend.HAExternalName {
+			conf.HANameservers = nameservers()
+			break
+		}
+	}
+	for _, backend := range conf.HAAuthBackends {
+		if backend.Resolve && conf.HANameservers == nil {
+			conf.HANameservers = nameservers()
+		}
+	}
+	for _, server := range haHTTPServers {
+		if server.HACanaryCookie {
+			conf.HACanaryCookie = true
+		}
+	}
+	if conf.AuthLDAPAgent != "" && !authLDAPAgentRegex.MatchString(conf.AuthLDAPAgent) {
+		glog.Warningf("ignoring invalid auth ldap agent, should be <host>:<port>: %v", conf.AuthLDAPAgent)
+		conf.AuthLDAPAgent = ""
+	}
+	for _, servers := range [][]*haproxyServer{haHTTPServers, haHTTPSServers} {
+		for _, server := range servers {
+			for _, location := range server.Locations {
+				if location.HAAuthRequest != nil {
+					conf.HAAuthRequest = true
+				}
+				if location.AuthType != "ldap" {
+					continue
+				}
+				// the ingress core doesn't know ldap, so the location isn't
+				// protected and shouldn't be served without the agent
+				if conf.AuthLDAPAgent == "" {
+					glog.Warningf("denying requests to %v%v, auth-type ldap needs auth-ldap-agent", server.Hostname, location.Path)
+					location.HAAuthDenied = true
+					continue
+				}
+				if strings.ContainsAny(location.AuthRealm, "\"\\\r\n") {
+					glog.Warningf("ignoring invalid auth realm of %v%v: %v", server.Hostname, location.Path, location.AuthRealm)
+					location.AuthRealm = ""
+				}
+				location.HAAuthLDAP = true
+				conf.HAAuthLDAP = true
+			}
+		}
+	}
 	return &conf
 }
 
-func newHAProxyServers(userlists map[string]userlist, servers []*ingress.Server) (haHTTPServers []*haproxyServer, haHTTPSServers []*haproxyServer, haDefaultServer *haproxyServer) {
+// tcpPorts lists the ports exposed by the TCP services and the tcp-sni frontends
+func (conf *configuration) tcpPorts() []int {
+	ports := make([]int, 0, len(conf.TCPEndpoints)+len(conf.HATCPSNIFrontends))
+	for _, tcp := range conf.TCPEndpoints {
+		ports = append(ports, tcp.Port)
+	}
+	for _, frontend := range conf.HATCPSNIFrontends {
+		ports = append(ports, frontend.Port)
+	}
+	return ports
+}
+
+// newHAProxyFrontends parses a comma-separated list of <name>=<bind>, e.g.
+// tenant-a=10.0.0.20:443, and assigns the hostnames whose ingress uses the
+// frontend annotation. Hostnames of a named frontend aren't served by the
+// default https frontend. The namespaces allowed to use a frontend can be
+// added after the bind, e.g. tenant-a=10.0.0.20:443;ns1,ns2
+func newHAProxyFrontends(list string, anns *ingressAnnotations, servers []*haproxyServer) []*haproxyFrontend {
+	frontends := []*haproxyFrontend{}
+	frontendNames := map[string]*haproxyFrontend{}
+	var last *haproxyFrontend
+	for _, item := range splitList(list) {
+		fe := strings.Split(item, "=")
+		if len(fe) == 1 && last != nil && last.namespaces != nil {
+			// another namespace of the previous frontend
+			last.namespaces[item] = true
+			continue
+		}
+		last = nil
+		if len(fe) != 2 || fe[0] == "" || fe[1] == "" {
+			glog.Warningf("invalid frontend format (name=bind[;namespaces]): %v", item)
+			continue
+		}
+		name := strings.TrimSpace(fe[0])
+		if _, found := frontendNames[name]; found {
+			glog.Warningf("duplicated frontend name: %v", name)
+			continue
+		}
+		bind := fe[1]
+		var namespaces map[string]bool
+		if pos := strings.Index(bind, ";"); pos >= 0 {
+			namespace := strings.TrimSpace(bind[pos+1:])
+			bind = bind[:pos]
+			if namespace == "" {
+				glog.Warningf("invalid frontend format (name=bind[;namespaces]): %v", item)
+				continue
+			}
+			namespaces = map[string]bool{namespace: true}
+		}
+		frontend := &haproxyFrontend{
+			Name:       name,
+			Bind:       strings.TrimSpace(bind),
+			Servers:    []*haproxyServer{},
+			namespaces: namespaces,
+		}
+		frontendNames[name] = frontend
+		frontends = append(frontends, frontend)
+		last = frontend
+	}
+	for _, server := range servers {
+		if server.IsDefaultServer {
+			continue
+		}
+		frontend := serverFrontend(anns, frontendNames, server)
+		if frontend == nil {
+			continue
+		}
+		server.HAFrontend = frontend.Name
+		frontend.Servers = append(frontend.Servers, server)
+	}
+	return frontends
+}
+
+// serverFrontend returns the frontend assigned to a hostname by the frontend
+// annotation of its locations. Annotations of ingress resources whose namespace
+// isn't allowed to use the frontend are ignored.
+func serverFrontend(anns *ingressAnnotations, frontends map[string]*haproxyFrontend, server *haproxyServer) *haproxyFrontend {
+	for _, location := range server.Locations {
+		if location.Frontend == "" {
+			continue
+		}
+		frontend, found := frontends[location.Frontend]
+		if !found {
+			glog.Warningf("frontend %v of hostname %v was not found", location.Frontend, server.Hostname)
+			continue
+		}
+		namespace := ""
+		if ing := anns.locationIngress(server.Hostname, location.Path); ing != nil {
+			namespace = ing.Namespace
+		}
+		if !frontend.allowed(namespace) {
+			glog.Warningf("ignoring frontend %v of %v%v, namespace '%v' isn't allowed to use it", frontend.Name, server.Hostname, location.Path, namespace)
+			continue
+		}
+		return frontend
+	}
+	return nil
+}
+
+// allowed returns true if the ingress resources of a namespace can assign
+// hostnames to the frontend, all namespaces are allowed if none was declared
+func (fe *haproxyFrontend) allowed(namespace string) bool {
+	return fe.namespaces == nil || fe.namespaces[namespace]
+}
+
+// assignHTTP2 configures HTTP/2 negotiation of the HTTPS hostnames. The http2
+// annotation of any ingress of a hostname overrides the ConfigMap default.
+func assignHTTP2(defaultHTTP2 bool, servers []*haproxyServer) {
+	for _, server := range servers {
+		server.HTTP2 = defaultHTTP2
+		for _, location := range server.Locations {
+			if location.HTTP2 == "" {
+				continue
+			}
+			http2, err := strconv.ParseBool(location.HTTP2)
+			if err != nil {
+				glog.Warningf("invalid http2 value of hostname %v: %v", server.Hostname, location.HTTP2)
+				continue
+			}
+			server.HTTP2 = http2
+			break
+		}
+	}
+}
+
+// defaultSSLCiphers is the intermediate compatibility list of Mozilla
+const defaultSSLCiphers = "ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-AES256-GCM-SHA384:DHE-RSA-AES128-GCM-SHA256:DHE-DSS-AES128-GCM-SHA256:kEDH+AESGCM:ECDHE-RSA-AES128-SHA256:ECDHE-ECDSA-AES128-SHA256:ECDHE-RSA-AES128-SHA:ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES256-SHA384:ECDHE-ECDSA-AES256-SHA384:ECDHE-RSA-AES256-SHA:ECDHE-ECDSA-AES256-SHA:DHE-RSA-AES128-SHA256:DHE-RSA-AES128-SHA:DHE-DSS-AES128-SHA256:DHE-RSA-AES256-SHA256:DHE-DSS-AES256-SHA:DHE-RSA-AES256-SHA:!aNULL:!eNULL:!EXPORT:!DES:!RC4:!3DES:!MD5:!PSK"
+
+// splitList splits a comma separated list of items from ConfigMap
+// or annotations, ignoring empty items
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newBinds returns the bind addresses of the http or https frontend, <ip>:<port>
+// followed by the items of extra, a comma-separated list of [<ip>:]<port> whose
+// address defaults to ip. Ports already in usedPorts are skipped, and the
+// bound ports are added to it.
+func newBinds(name, ip string, port int, extra string, usedPorts map[int]bool) []string {
+	if ip != "*" && net.ParseIP(ip) == nil {
+		glog.Warningf("invalid bind ip addr of %v, using *: %v", name, ip)
+		ip = "*"
+	}
+	binds := []string{fmt.Sprintf("%v:%v", ip, port)}
+	for _, item := range splitList(extra) {
+		bindIP, bindPort := ip, item
+		if i := strings.LastIndex(item, ":"); i >= 0 {
+			bindIP, bindPort = item[:i], item[i+1:]
+		}
+		if bindIP != "*" && net.ParseIP(bindIP) == nil {
+			glog.Warningf("ignoring invalid extra bind of %v: %v", name, item)
+			continue
+		}
+		p, err := strconv.Atoi(bindPort)
+		if err != nil || p <= 0 || p > 65535 {
+			glog.Warningf("ignoring invalid extra bind of %v: %v", name, item)
+			continue
+		}
+		if usedPorts[p] {
+			glog.Warningf("ignoring extra bind of %v, port %v is already in use: %v", name, p, item)
+			continue
+		}
+		usedPorts[p] = true
+		binds = append(binds, fmt.Sprintf("%v:%v", bindIP, p))
+	}
+	return binds
+}
+
+// acceptProxy reads the use-proxy-protocol override of a bind,
+// which defaults to the use-proxy-protocol option
+func acceptProxy(data map[string]string, key string, def bool) bool {
+	value, found := data[key]
+	if !found {
+		return def
+	}
+	accept, err := strconv.ParseBool(value)
+	if err != nil {
+		glog.Warningf("invalid %v, using %v: %v", key, def, value)
+		return def
+	}
+	return accept
+}
+
+// sourceRange returns the valid IPs and CIDRs of a comma separated list,
+// prefixed with a space, which is the format used by the src ACL
+func sourceRange(name, list string) string {
+	var haSourceRange string
+	for _, cidr := range splitList(list) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			glog.Warningf("ignoring invalid %v: %v", name, cidr)
+			continue
+		}
+		haSourceRange = haSourceRange + " " + cidr
+	}
+	return haSourceRange
+}
+
+func newHAProxyBackends(anns *ingressAnnotations, backends []*ingress.Backend, data map[string]string) []*haproxyBackend {
+	haBackends := make([]*haproxyBackend, len(backends))
+	for i, backend := range backends {
+		haBackend := haproxyBackend{
+			Backend: backend,
+			backendConfig: backendConfig{
+				HealthCheck:      true,
+				HealthCheckInter: "2s",
+				BackendSNI:       defaultBackendSNI,
+				SlotsIncrement:   10,
+				BalanceAlgorithm: "roundrobin",
+			},
+		}
+		mergeMap(data, &haBackend.backendConfig)
+		mergeMap(anns.backend(backend.Name), &haBackend.backendConfig)
+		haBackend.HAEndpoints = newHAProxyEndpoints(anns, &haBackend)
+		if haBackend.HAExternalName && haBackend.DynamicScaling {
+			// server addresses can't be changed to a DNS name on the admin socket
+			haBackend.DynamicScaling = false
+		}
+		if haBackend.ServerMaxConn > 0 {
+			haBackend.MaxConnServer = haBackend.ServerMaxConn
+		} else {
+			haBackend.MaxConnServer = serverMaxConn(haBackend.MaxConnBackend, len(haBackend.HAEndpoints))
+		}
+		if !validBalanceAlgorithm(haBackend.BalanceAlgorithm) {
+			glog.Warningf("invalid balance algorithm of backend %v, using roundrobin: %v", backend.Name, haBackend.BalanceAlgorithm)
+			haBackend.BalanceAlgorithm = "roundrobin"
+		}
+		for _, timeout := range []*string{&haBackend.TimeoutConnect, &haBackend.TimeoutServer, &haBackend.TimeoutTunnel} {
+			if *timeout != "" && !validTimeout(*timeout) {
+				glog.Warningf("invalid timeout of backend %v, using the default one: %v", backend.Name, *timeout)
+				*timeout = ""
+			}
+		}
+		if !backendSNIRegex.MatchString(haBackend.BackendSNI) {
+			glog.Warningf("invalid backend-sni of backend %v, using the default one: %v", backend.Name, haBackend.BackendSNI)
+			haBackend.BackendSNI = defaultBackendSNI
+		}
+		if haBackend.SlowStart != "" && !validTimeout(haBackend.SlowStart) {
+			glog.Warningf("invalid slowstart of backend %v: %v", backend.Name, haBackend.SlowStart)
+			haBackend.SlowStart = ""
+		}
+		switch haBackend.HTTPReuse {
+		case "", "never", "safe", "aggressive", "always":
+		default:
+			glog.Warningf("invalid http-reuse of backend %v, should be never, safe, aggressive or always: %v", backend.Name, haBackend.HTTPReuse)
+			haBackend.HTTPReuse = ""
+		}
+		haBackend.HACheckParams = checkParams(&haBackend)
+		haBackend.HAAgentCheck = agentCheckParams(&haBackend)
+		switch haBackend.ProxyProtocol {
+		case "":
+		case "v1":
+			haBackend.HASendProxy = "send-proxy"
+		case "v2":
+			haBackend.HASendProxy = "send-proxy-v2"
+		default:
+			glog.Warningf("invalid proxy protocol version of backend %v, should be v1 or v2: %v", backend.Name, haBackend.ProxyProtocol)
+		}
+		if snippet, err := configSnippet(haBackend.ConfigBackend); err == nil {
+			haBackend.HAConfigBackend = snippet
+		} else {
+			glog.Warningf("ignoring config snippet of backend %v: %v", backend.Name, err)
+		}
+		if haBackend.Secure && haBackend.SecureVerifyCA != "" {
+			secretName := anns.namespace(backend.Name) + "/" + haBackend.SecureVerifyCA
+			if ca, err := secretCAFile(anns, "backend-"+backend.Name, secretName); err == nil {
+				haBackend.HASecureCAFile, haBackend.HASecureCAChecksum = ca.CAFileName, ca.PemSHA
+			} else {
+				glog.Warningf("error reading CA of backend %v, server certificates won't be verified: %v", backend.Name, err)
+			}
+		}
+		if haBackend.ErrorPage503 != "" {
+			haBackend.HAErrorFile503, haBackend.HAErrorFile503Checksum = errorFile503(anns, &haBackend)
+		}
+		haBackends[i] = &haBackend
+	}
+	return haBackends
+}
+
+var balanceAlgorithmRegex = regexp.MustCompile(`^(roundrobin|static-rr|leastconn|first|source|uri|url_param|hdr\([A-Za-z0-9_-]+\)|rdp-cookie(\([A-Za-z0-9_-]+\))?)( [A-Za-z0-9_-]+)*$`)
+
+// validBalanceAlgorithm checks the algorithm name, and also avoids
+// annotations with line breaks changing the configuration
+func validBalanceAlgorithm(algorithm string) bool {
+	return balanceAlgorithmRegex.MatchString(algorithm)
+}
+
+var healthCheckURIRegex = regexp.MustCompile(`^/[^\s]*$`)
+
+// checkParams validates the health check options of a backend and builds the
+// check parameters of its server lines. An invalid uri disables the http check.
+func checkParams(haBackend *haproxyBackend) string {
+	if haBackend.HealthCheckURI != "" && !healthCheckURIRegex.MatchString(haBackend.HealthCheckURI) {
+		glog.Warningf("invalid health check uri of backend %v: %v", haBackend.Name, haBackend.HealthCheckURI)
+		haBackend.HealthCheckURI = ""
+	}
+	if !validTimeout(haBackend.HealthCheckInter) {
+		glog.Warningf("invalid health check interval of backend %v, using 2s: %v", haBackend.Name, haBackend.HealthCheckInter)
+		haBackend.HealthCheckInter = "2s"
+	}
+	params := "inter " + haBackend.HealthCheckInter
+	if haBackend.HealthCheckRise > 0 {
+		params = params + " rise " + strconv.Itoa(haBackend.HealthCheckRise)
+	}
+	if haBackend.HealthCheckFall > 0 {
+		params = params + " fall " + strconv.Itoa(haBackend.HealthCheckFall)
+	}
+	return params
+}
+
+var agentCheckAddrRegex = regexp.MustCompile(`^[A-Za-z0-9.:-]+$`)
+
+// agentCheckParams builds the agent check parameters of the server lines of a
+// backend, agent checks are disabled if agent-check-port isn't declared
+func agentCheckParams(haBackend *haproxyBackend) string {
+	if haBackend.AgentCheckPort <= 0 {
+		return ""
+	}
+	if haBackend.AgentCheckPort > 65535 {
+		glog.Warningf("invalid agent check port of backend %v: %v", haBackend.Name, haBackend.AgentCheckPort)
+		return ""
+	}
+	params := "agent-check agent-port " + strconv.Itoa(haBackend.AgentCheckPort)
+	if haBackend.AgentCheckAddr != "" {
+		if agentCheckAddrRegex.MatchString(haBackend.AgentCheckAddr) {
+			params = params + " agent-addr " + haBackend.AgentCheckAddr
+		} else {
+			glog.Warningf("ignoring invalid agent check address of backend %v: %v", haBackend.Name, haBackend.AgentCheckAddr)
+		}
+	}
+	if haBackend.AgentCheckInter != "" {
+		if validTimeout(haBackend.AgentCheckInter) {
+			params = params + " agent-inter " + haBackend.AgentCheckInter
+		} else {
+			glog.Warningf("ignoring invalid agent check interval of backend %v: %v", haBackend.Name, haBackend.AgentCheckInter)
+		}
+	}
+	return params
+}
+
+const (
+	// httpLogFormatDefault is the format of option httplog
+	httpLogFormatDefault = `%ci:%cp [%tr] %ft %b/%s %TR/%Tw/%Tc/%Tr/%Ta %ST %B %CC %CS %tsc %ac/%fc/%bc/%sc/%rc %sq/%bq %hr %hs %{+Q}r`
+	// httpLogFormatJSON and tcpLogFormatJSON are the log formats used by the json
+	// value of http-log-format and tcp-log-format. Values which can have spaces use
+	// the +Q flag, which quotes them. The host is saved in txn.host because request
+	// headers aren't available when the log is emitted.
+	httpLogFormatJSON = `{"time":"%t","client_ip":"%ci","client_port":%cp,"frontend":"%f","backend":"%b","server":"%s",` +
+		`"method":%{+Q}HM,"host":%{+Q}[var(txn.host)],"path":%{+Q}HP,"version":%{+Q}HV,"status":%ST,"bytes":%B,` +
+		`"request_ms":%TR,"queue_ms":%Tw,"connect_ms":%Tc,"response_ms":%Tr,"total_ms":%Ta,"termination_state":"%tsc"}`
+	tcpLogFormatJSON = `{"time":"%t","client_ip":"%ci","client_port":%cp,"frontend":"%f","backend":"%b","server":"%s",` +
+		`"bytes":%B,"queue_ms":%Tw,"connect_ms":%Tc,"total_ms":%Tt,"termination_state":"%ts"}`
+)
+
+// logFormat quotes a log format to be used as the argument of log-format,
+// an empty string is returned if the format isn't valid
+func logFormat(name, format string) string {
+	if format == "" {
+		return ""
+	}
+	if strings.ContainsAny(format, "\r\n") {
+		glog.Warningf("ignoring %v with line breaks: %v", name, format)
+		return ""
+	}
+	return `"` + strings.Replace(format, `"`, `\"`, -1) + `"`
+}
+
+// serviceRegex matches <service>:<port>, a DNS-1123 service name and the
+// number or the name of a port of the service
+var serviceRegex = regexp.MustCompile(`^([a-z0-9]([-a-z0-9]*[a-z0-9])?):([A-Za-z0-9-]+)$`)
+
+const defaultBackendSNI = "req.hdr(host),field(1,:)"
+
+// backendSNIRegex matches a sample expression without spaces, e.g. the default one
+var backendSNIRegex = regexp.MustCompile(`^[A-Za-z0-9_.,:()-]*$`)
+
+var headerNameRegex = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+var cookieNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// canaryValueRegex is a conservative subset of the token chars of RFC 7230
+var canaryValueRegex = regexp.MustCompile(`^[A-Za-z0-9_.~+-]+$`)
+
+var authLDAPAgentRegex = regexp.MustCompile(`^[A-Za-z0-9.-]+:[0-9]+$`)
+
+var syslogFacilityRegex = regexp.MustCompile(`^(kern|user|mail|daemon|auth|syslog|lpr|news|uucp|cron|auth2|ftp|ntp|audit|alert|cron2|local[0-7])$`)
+
+var syslogLevelRegex = regexp.MustCompile(`^(emerg|alert|crit|err|warning|notice|info|debug)$`)
+
+var timeoutRegex = regexp.MustCompile(`^[0-9]+(us|ms|s|m|h|d)?$`)
+
+func validTimeout(timeout string) bool {
+	return timeoutRegex.MatchString(timeout)
+}
+
+var timeoutUnits = map[string]time.Duration{
+	"":   time.Millisecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+}
+
+// timeoutDuration converts a valid timeout, see validTimeout, to a duration.
+// HAProxy uses milliseconds if the unit is missing.
+func timeoutDuration(timeout string) time.Duration {
+	number := strings.TrimRight(timeout, "usmhd")
+	value, _ := strconv.ParseInt(number, 10, 64)
+	return time.Duration(value) * timeoutUnits[timeout[len(number):]]
+}
+
+// canaryMatch builds the conditions which route a request to the canary service:
+// a header or a cookie whose value is `always`, or the configured header value,
+// or a random percent of the requests. Sticky canaries assign the variant on the
+// first request, see haproxy.tmpl, and use the cookie from then on.
+func canaryMatch(config *locationConfig) []string {
+	match := []string{}
+	if config.CanaryByHeader != "" {
+		value := config.CanaryHeaderValue
+		if value == "" {
+			value = "always"
+		}
+		match = append(match, fmt.Sprintf(" { req.hdr(%v) -m str %v }", config.CanaryByHeader, value))
+	}
+	if config.CanaryByCookie != "" {
+		match = append(match, fmt.Sprintf(" { req.cook(%v) -m str always }", config.CanaryByCookie))
+	}
+	if config.CanaryWeight > 0 {
+		if config.CanaryStickyCookie != "" {
+			cookie := config.CanaryStickyCookie
+			match = append(match,
+				fmt.Sprintf(" { req.cook(%v) -m str canary }", cookie),
+				fmt.Sprintf(" { var(txn.canary_cookie) -m str %v=canary }", cookie))
+		} else {
+			match = append(match, fmt.Sprintf(" { rand(100) lt %v }", config.CanaryWeight))
+		}
+	}
+	return match
+}
+
+// errorFile503 saves the page declared on the error-page-503 option, <configmap>/<key>,
+// as a HAProxy errorfile. The ConfigMap should be in the same namespace of the ingress.
+func errorFile503(anns *ingressAnnotations, haBackend *haproxyBackend) (string, string) {
+	ref := strings.Split(haBackend.ErrorPage503, "/")
+	if len(ref) != 2 {
+		glog.Warningf("invalid error page format (configmap/key) '%v' on backend %v", haBackend.ErrorPage503, haBackend.Name)
+		return "", ""
+	}
+	html, err := anns.configMapValue(anns.namespace(haBackend.Name)+"/"+ref[0], ref[1])
+	if err != nil {
+		glog.Warningf("error reading error page of backend %v: %v", haBackend.Name, err)
+		return "", ""
+	}
+	fileName, checksum, err := writeErrorFile(haBackend.Name+"-503", errorFileHeader(503), html)
+	if err != nil {
+		glog.Warningf("error writing error page of backend %v: %v", haBackend.Name, err)
+		return "", ""
+	}
+	return fileName, checksum
+}
+
+// errorFileStatus are the status codes which HAProxy can use on deny_status and errorfile
+var errorFileStatus = map[int]bool{200: true, 400: true, 403: true, 405: true, 408: true, 429: true, 500: true, 502: true, 503: true, 504: true}
+
+// denyErrorFile saves the HTML page, <namespace>/<configmap>/<key>,
+// used on requests denied by the whitelist and blacklist of a location
+func denyErrorFile(anns *ingressAnnotations, page string, status int) (string, string) {
+	ref := strings.Split(page, "/")
+	if len(ref) != 3 {
+		glog.Warningf("invalid whitelist deny page format (namespace/configmap/key): %v", page)
+		return "", ""
+	}
+	html, err := anns.configMapValue(ref[0]+"/"+ref[1], ref[2])
+	if err != nil {
+		glog.Warningf("error reading whitelist deny page: %v", err)
+		return "", ""
+	}
+	fileName, checksum, err := writeErrorFile(fmt.Sprintf("deny-%v", status), errorFileHeader(status), html)
+	if err != nil {
+		glog.Warningf("error writing whitelist deny page: %v", err)
+		return "", ""
+	}
+	return fileName, checksum
+}
+
+// newHAProxyEndpoints adds the not ready endpoints of the service on
+// backends configured to use them, optionally as backup servers, as
+// well as the endpoints of the backup service of the backend
+func newHAProxyEndpoints(anns *ingressAnnotations, haBackend *haproxyBackend) []*haproxyEndpoint {
+	if endpoint := anns.externalNameEndpoint(haBackend.Name); endpoint != nil {
+		haBackend.HAExternalName = true
+		return []*haproxyEndpoint{{Endpoint: *endpoint, Weight: -1}}
+	}
+	endpoints := make([]*haproxyEndpoint, 0, len(haBackend.Endpoints))
+	for _, endpoint := range haBackend.Endpoints {
+		endpoints = append(endpoints, &haproxyEndpoint{Endpoint: endpoint})
+	}
+	switch haBackend.NotReadyEndpoints {
+	case "", "ignore":
+	case "include", "backup":
+		if len(endpoints) == 1 && endpoints[0].Endpoint == emptyBackendEndpoint {
+			endpoints = endpoints[:0]
+		}
+		for _, endpoint := range anns.notReadyEndpoints(haBackend.Name) {
+			endpoints = append(endpoints, &haproxyEndpoint{
+				Endpoint: endpoint,
+				Backup:   haBackend.NotReadyEndpoints == "backup",
+			})
+		}
+		if len(endpoints) == 0 {
+			endpoints = append(endpoints, &haproxyEndpoint{Endpoint: emptyBackendEndpoint})
+		}
+	default:
+		glog.Warningf("ignoring invalid not-ready-endpoints option '%v' on backend %v", haBackend.NotReadyEndpoints, haBackend.Name)
+	}
+	if haBackend.BackupService != "" {
+		if svc := serviceRegex.FindStringSubmatch(haBackend.BackupService); svc != nil {
+			for _, endpoint := range anns.serviceEndpoints(anns.namespace(haBackend.Name), svc[1], svc[3], false) {
+				endpoints = append(endpoints, &haproxyEndpoint{
+					Endpoint: endpoint,
+					Backup:   true,
+				})
+			}
+		} else {
+			glog.Warningf("invalid backup service format (name:port) '%v' on backend %v", haBackend.BackupService, haBackend.Name)
+		}
+	}
+	for _, endpoint := range endpoints {
+		endpoint.Weight = anns.pods.weight(endpoint.Address)
+	}
+	return endpoints
+}
+
+// serviceBackendName uses the backend naming convention of the ingress core.
+// Services referenced by annotations should be in the same namespace of the ingress.
+func serviceBackendName(anns *ingressAnnotations, hostname, path, service string) string {
+	svc := serviceRegex.FindStringSubmatch(service)
+	ing := anns.locationIngress(hostname, path)
+	if svc == nil || ing == nil {
+		glog.Warningf("invalid service format (name:port) '%v' on %v%v", service, hostname, path)
+		return ""
+	}
+	return fmt.Sprintf("%v-%v-%v", ing.Namespace, svc[1], svc[3])
+}
+
+// newServiceBackends creates the backends of the services referenced by
+// location annotations which aren't already used as a backend of any ingress
+func newServiceBackends(anns *ingressAnnotations, data map[string]string, haBackends []*haproxyBackend, serverLists ...[]*haproxyServer) []*haproxyBackend {
+	backendNames := make(map[string]bool, len(haBackends))
+	for _, haBackend := range haBackends {
+		backendNames[haBackend.Name] = true
+	}
+	backends := []*ingress.Backend{}
+	addBackend := func(hostname, path, name, service string) {
+		if name == "" || backendNames[name] {
+			return
+		}
+		backendNames[name] = true
+		ing := anns.locationIngress(hostname, path)
+		svc := serviceRegex.FindStringSubmatch(service)
+		endpoints := anns.serviceEndpoints(ing.Namespace, svc[1], svc[3], false)
+		if len(endpoints) == 0 {
+			endpoints = []ingress.Endpoint{emptyBackendEndpoint}
+		}
+		backends = append(backends, &ingress.Backend{
+			Name:      name,
+			Endpoints: endpoints,
+		})
+	}
+	for _, servers := range serverLists {
+		for _, server := range servers {
+			for _, location := range server.Locations {
+				addBackend(server.Hostname, location.Path, location.HAFailover, location.FailoverService)
+				addBackend(server.Hostname, location.Path, location.HACanary, location.CanaryService)
+			}
+		}
+	}
+	return newHAProxyBackends(anns, backends, data)
+}
+
+// serverMaxConn splits the backend capacity between its endpoints,
+// so the limit is recalculated whenever the service scales.
+func serverMaxConn(backendMaxConn, endpoints int) int {
+	if backendMaxConn <= 0 || endpoints == 0 {
+		return 0
+	}
+	return (backendMaxConn + endpoints - 1) / endpoints
+}
+
+func newHAProxyServers(userlists map[string]userlist, anns *ingressAnnotations, servers []*ingress.Server) (haHTTPServers []*haproxyServer, haHTTPSServers []*haproxyServer, haDefaultServer *haproxyServer) {
 	haHTTPServers = make([]*haproxyServer, 0, len(servers))
 	haHTTPSServers = make([]*haproxyServer, 0, len(servers))
 	for _, server := range servers {
-		haLocations, haRootLocation := newHAProxyLocations(userlists, server)
+		haLocations, haRootLocation := newHAProxyLocations(userlists, anns, server)
 		haServer := haproxyServer{
 			// Ingress uses `_` hostname as default server
 			IsDefaultServer: server.Hostname == "_",
@@ -122,9 +1219,29 @@ func newHAProxyServers(userlists map[string]userlist, servers []*ingress.Server)
 			Locations:       haLocations,
 			SSLRedirect:     serverSSLRedirect(server),
 		}
+		haServer.HACAFile, haServer.HACAChecksum = serverAuthTLS(server)
+		for _, location := range haLocations {
+			if location.HAAuthTLS && location.AuthTLSVerifyClient == "optional" {
+				haServer.HACAOptional = true
+			}
+		}
+		for _, location := range haLocations {
+			if location.CanaryStickyCookie != "" {
+				haServer.HACanaryCookie = true
+			}
+		}
+		if haRootLocation != nil && haRootLocation.AppRoot != "" {
+			if rewritePathRegex.MatchString(haRootLocation.AppRoot) {
+				haServer.HAAppRoot = haRootLocation.AppRoot
+			} else {
+				glog.Warningf("ignoring app-root of %v, unsupported characters: %v", server.Hostname, haRootLocation.AppRoot)
+			}
+		}
 		if haServer.IsDefaultServer {
 			haDefaultServer = &haServer
-		} else if haServer.SSLCertificate == "" {
+		} else if haServer.SSLCertificate == "" || server.SSLPassthrough {
+			// TLS connections of ssl-passthrough hostnames are sent as is to the
+			// endpoints, HAProxy only serves their plain HTTP requests
 			haHTTPServers = append(haHTTPServers, &haServer)
 		} else {
 			haHTTPSServers = append(haHTTPSServers, &haServer)
@@ -136,8 +1253,11 @@ func newHAProxyServers(userlists map[string]userlist, servers []*ingress.Server)
 	return
 }
 
-func newHAProxyLocations(userlists map[string]userlist, server *ingress.Server) (haLocations []*haproxyLocation, haRootLocation *haproxyLocation) {
-	locations := server.Locations
+func newHAProxyLocations(userlists map[string]userlist, anns *ingressAnnotations, server *ingress.Server) (haLocations []*haproxyLocation, haRootLocation *haproxyLocation) {
+	// Locations are matched in order, so the most specific paths should come first
+	locations := make([]*ingress.Location, len(server.Locations))
+	copy(locations, server.Locations)
+	sort.Stable(locationBySpecificity(locations))
 	haLocations = make([]*haproxyLocation, len(locations))
 	otherPaths := ""
 	for i, location := range locations {
@@ -145,17 +1265,88 @@ func newHAProxyLocations(userlists map[string]userlist, server *ingress.Server)
 		for _, cidr := range location.Whitelist.CIDR {
 			haWhitelist = haWhitelist + " " + cidr
 		}
-		users, ok := userlists[location.BasicDigestAuth.File]
+		users, ok := userlists[anns.authSecret(server.Hostname, location.Path)]
 		if !ok {
 			users = userlist{}
 		}
+		// the realm belongs to the location, userlists can be shared
+		users.Realm = location.BasicDigestAuth.Realm
+		// HAProxy cannot check digest credentials, and a location without
+		// its userlist shouldn't be served without authentication
+		authDenied := location.BasicDigestAuth.Secured && !ok
+		if authDenied {
+			glog.Warningf("denying requests to %v%v, %v authentication is not supported or its users couldn't be read",
+				server.Hostname, location.Path, location.BasicDigestAuth.Type)
+		}
+		// the CA of a location is missing if the ingress core couldn't read its secret
+		authTLS := location.CertificateAuth.AuthSSLCert.CAFileName != ""
+		if !authTLS && anns.location(server.Hostname, location.Path)["auth-tls-secret"] != "" {
+			glog.Warningf("denying requests to %v%v, the CA of auth-tls-secret couldn't be read", server.Hostname, location.Path)
+			authDenied = true
+		}
 		haLocation := haproxyLocation{
+			locationConfig: newDefaultLocationConfig(),
 			IsRootLocation: location.Path == "/",
 			Path:           location.Path,
 			Backend:        location.Backend,
 			Redirect:       location.Redirect,
 			Userlist:       users,
 			HAWhitelist:    haWhitelist,
+			HAAuthDenied:   authDenied,
+			HAAuthTLS:      authTLS,
+		}
+		mergeMap(anns.location(server.Hostname, location.Path), &haLocation.locationConfig)
+		if ing := anns.locationIngress(server.Hostname, location.Path); ing != nil {
+			haLocation.HANamespace = ing.Namespace
+			haLocation.HAIngress = ing.Name
+			haLocation.HAService = anns.serviceName(location.Backend)
+		}
+		if haLocation.FailoverService != "" {
+			haLocation.HAFailover = serviceBackendName(anns, server.Hostname, location.Path, haLocation.FailoverService)
+		}
+		if haLocation.CanaryByHeader != "" && !headerNameRegex.MatchString(haLocation.CanaryByHeader) {
+			glog.Warningf("ignoring invalid canary-by-header of %v%v: %v", server.Hostname, location.Path, haLocation.CanaryByHeader)
+			haLocation.CanaryByHeader = ""
+		}
+		if haLocation.CanaryHeaderValue != "" && !canaryValueRegex.MatchString(haLocation.CanaryHeaderValue) {
+			glog.Warningf("ignoring invalid canary-by-header-value of %v%v: %v", server.Hostname, location.Path, haLocation.CanaryHeaderValue)
+			haLocation.CanaryHeaderValue = ""
+		}
+		if haLocation.CanaryByCookie != "" && !cookieNameRegex.MatchString(haLocation.CanaryByCookie) {
+			glog.Warningf("ignoring invalid canary-by-cookie of %v%v: %v", server.Hostname, location.Path, haLocation.CanaryByCookie)
+			haLocation.CanaryByCookie = ""
+		}
+		if haLocation.CanaryStickyCookie != "" && !cookieNameRegex.MatchString(haLocation.CanaryStickyCookie) {
+			glog.Warningf("ignoring invalid canary-sticky-cookie of %v%v: %v", server.Hostname, location.Path, haLocation.CanaryStickyCookie)
+			haLocation.CanaryStickyCookie = ""
+		}
+		if haLocation.CanaryService != "" {
+			haLocation.HACanary = serviceBackendName(anns, server.Hostname, location.Path, haLocation.CanaryService)
+			haLocation.HACanaryMatch = canaryMatch(&haLocation.locationConfig)
+		}
+		if haLocation.HACanary == "" || haLocation.CanaryWeight <= 0 {
+			haLocation.CanaryStickyCookie = ""
+		}
+		for _, cidr := range splitList(haLocation.BlacklistSourceRange) {
+			if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+				glog.Warningf("ignoring invalid blacklist source range of %v%v: %v", server.Hostname, location.Path, cidr)
+				continue
+			}
+			haLocation.HABlacklist = haLocation.HABlacklist + " " + cidr
+		}
+		if haLocation.AuthTLSVerifyClient != "on" && haLocation.AuthTLSVerifyClient != "optional" {
+			glog.Warningf("ignoring invalid auth-tls-verify-client of %v%v, should be on or optional: %v",
+				server.Hostname, location.Path, haLocation.AuthTLSVerifyClient)
+			haLocation.AuthTLSVerifyClient = "on"
+		}
+		haLocation.HARateLimit = newHAProxyRateLimit(server.Hostname, &haLocation)
+		if location.EnableCORS {
+			haLocation.HACORS = newHAProxyCORS(server.Hostname, &haLocation)
+		}
+		if haLocation.OAuth != "" {
+			haLocation.HAAuthRequest = newHAProxyOAuth(server, &haLocation)
+		} else if location.ExternalAuth.URL != "" {
+			haLocation.HAAuthRequest = newHAProxyAuthURL(server.Hostname, &haLocation, location.ExternalAuth.URL)
 		}
 		// RootLocation `/` means "any other URL" on Ingress.
 		// HAMatchPath build this strategy on HAProxy.
@@ -173,43 +1364,100 @@ func newHAProxyLocations(userlists map[string]userlist, server *ingress.Server)
 	return
 }
 
-// This could be improved creating a list of auth secrets (or even configMaps)
-// on Ingress and saving usr(s)/pwd in auth.BasicDigest struct
-func newUserlists(servers []*ingress.Server) map[string]userlist {
+// locationBySpecificity sorts locations from the longest to the shortest path,
+// so `/api/v2` is matched before `/api` regardless of the ingress which declares them.
+// Paths with the same length are sorted alphabetically.
+type locationBySpecificity []*ingress.Location
+
+func (l locationBySpecificity) Len() int      { return len(l) }
+func (l locationBySpecificity) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l locationBySpecificity) Less(i, j int) bool {
+	if len(l[i].Path) != len(l[j].Path) {
+		return len(l[i].Path) > len(l[j].Path)
+	}
+	return l[i].Path < l[j].Path
+}
+
+// newUserlists reads the users of the basic auth locations from their secrets,
+// the userlists are indexed by the <namespace>/<name> of the secret. Secrets
+// with the same users share the same ListName, see userlistName.
+func newUserlists(anns *ingressAnnotations, servers []*ingress.Server) map[string]userlist {
 	userlists := map[string]userlist{}
 	for _, server := range servers {
 		for _, location := range server.Locations {
-			fileName := location.BasicDigestAuth.File
-			authType := location.BasicDigestAuth.Type
-			if fileName != "" && authType != "digest" {
-				_, ok := userlists[fileName]
-				if !ok {
-					slashPos := strings.LastIndex(fileName, "/")
-					dotPos := strings.LastIndex(fileName, ".")
-					listName := fileName[slashPos+1 : dotPos]
-					users, err := readUsers(fileName, listName)
-					if err != nil {
-						glog.Errorf("Unexpected error reading %v: %v", listName, err)
-						break
-					}
-					userlists[fileName] = userlist{
-						ListName: listName,
-						Realm:    location.BasicDigestAuth.Realm,
-						Users:    users,
-					}
-				}
+			if !location.BasicDigestAuth.Secured || location.BasicDigestAuth.Type == "digest" {
+				continue
+			}
+			secretName := anns.authSecret(server.Hostname, location.Path)
+			if _, found := userlists[secretName]; found || secretName == "" {
+				continue
+			}
+			users, err := secretUsers(anns, secretName, secretName)
+			if err != nil {
+				glog.Errorf("error reading the users of %v: %v", secretName, err)
+				continue
+			}
+			userlists[secretName] = userlist{
+				ListName: userlistName(users),
+				Users:    users,
 			}
 		}
 	}
 	return userlists
 }
 
-func readUsers(fileName string, listName string) ([]authUser, error) {
-	file, err := os.Open(fileName)
+// userlistName names a userlist after a hash of its users, so secrets with
+// the same users, usually copied to every namespace that needs them, are
+// rendered as a single userlist
+func userlistName(users []authUser) string {
+	lines := make([]string, len(users))
+	for i, user := range users {
+		lines[i] = fmt.Sprintf("%v:%v:%v", user.Username, user.Encrypted, user.Password)
+	}
+	sort.Strings(lines)
+	return fmt.Sprintf("userlist-%x", sha1.Sum([]byte(strings.Join(lines, "\n"))))[:21]
+}
+
+// uniqueUserlists lists the userlists sorted by ListName, without duplicates
+func uniqueUserlists(userlists map[string]userlist) []userlist {
+	lists := map[string]userlist{}
+	for _, list := range userlists {
+		lists[list.ListName] = list
+	}
+	names := make([]string, 0, len(lists))
+	for name := range lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	uniqueList := make([]userlist, len(names))
+	for i, name := range names {
+		uniqueList[i] = lists[name]
+	}
+	return uniqueList
+}
+
+// secretUsers reads the users from the auth key of a secret
+func secretUsers(anns *ingressAnnotations, secretName, listName string) ([]authUser, error) {
+	if anns.lister == nil {
+		return nil, fmt.Errorf("secret %v was not found", secretName)
+	}
+	obj, exists, err := anns.lister.Secret.GetByKey(secretName)
 	if err != nil {
 		return nil, err
 	}
-	scanner := bufio.NewScanner(file)
+	if !exists {
+		return nil, fmt.Errorf("secret %v was not found", secretName)
+	}
+	auth, found := obj.(*api.Secret).Data["auth"]
+	if !found {
+		return nil, fmt.Errorf("secret %v should have auth", secretName)
+	}
+	return parseUsers(bytes.NewReader(auth), listName), nil
+}
+
+// parseUsers reads users in the htpasswd format, usr:encrypted or usr::plain
+func parseUsers(reader io.Reader, listName string) []authUser {
+	scanner := bufio.NewScanner(reader)
 	users := []authUser{}
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -244,7 +1492,7 @@ func readUsers(fileName string, listName string) ([]authUser, error) {
 		}
 		users = append(users, user)
 	}
-	return users, nil
+	return users
 }
 
 func serverSSLRedirect(server *ingress.Server) bool {
@@ -261,3 +1509,25 @@ func newDefaultConfig() defaults.Backend {
 		SSLRedirect: true,
 	}
 }
+
+// newBackendDefaults reads the defaults of the ingress core from ConfigMap.
+// whitelist-source-range is applied by the frontends, see HAWhitelist, so
+// it isn't used as the default whitelist of the locations.
+func newBackendDefaults(data map[string]string) defaults.Backend {
+	def := newDefaultConfig()
+	mergeMap(data, &def)
+	def.WhitelistSourceRange = nil
+	return def
+}
+
+func newDefaultLocationConfig() locationConfig {
+	return locationConfig{
+		CORSAllowOrigin:      "*",
+		CORSAllowMethods:     "GET, PUT, POST, DELETE, PATCH, OPTIONS",
+		CORSAllowHeaders:     "DNT,X-CustomHeader,Keep-Alive,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type,Authorization",
+		CORSAllowCredentials: true,
+		CORSMaxAge:           1728000,
+		OAuthURIPrefix:       "/oauth2",
+		AuthTLSVerifyClient:  "on",
+	}
+}
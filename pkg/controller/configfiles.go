@@ -0,0 +1,79 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+)
+
+// configFileRegex matches the comments of the template which
+// start the content of a new file on split configurations
+var configFileRegex = regexp.MustCompile(`(?m)^# file: ([a-z0-9-]+)\n`)
+
+type configFile struct {
+	name    string
+	content []byte
+}
+
+// splitConfig splits a rendered configuration into the files declared by the
+// template. Content before the first declared file is added to the first one.
+func splitConfig(data []byte) []*configFile {
+	matches := configFileRegex.FindAllSubmatchIndex(data, -1)
+	if len(matches) == 0 {
+		return []*configFile{{name: "global", content: data}}
+	}
+	files := make([]*configFile, len(matches))
+	for i, match := range matches {
+		start := match[1]
+		if i == 0 {
+			start = 0
+		}
+		end := len(data)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		files[i] = &configFile{
+			name:    string(data[match[2]:match[3]]),
+			content: data[start:end],
+		}
+	}
+	return files
+}
+
+// writeConfigFiles saves every file of a split configuration in dir,
+// named haproxy-<name>.cfg. Files whose content didn't change aren't
+// rewritten. The file names are returned in the order they should be
+// loaded by HAProxy.
+func writeConfigFiles(dir string, data []byte) ([]string, error) {
+	files := splitConfig(data)
+	fileNames := make([]string, len(files))
+	for i, file := range files {
+		fileName := filepath.Join(dir, fmt.Sprintf("haproxy-%v.cfg", file.name))
+		fileNames[i] = fileName
+		if current, err := ioutil.ReadFile(fileName); err == nil && bytes.Equal(current, file.content) {
+			continue
+		}
+		if err := ioutil.WriteFile(fileName, file.content, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return fileNames, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress"
+	"k8s.io/ingress/core/pkg/ingress/annotations/auth"
+	"k8s.io/ingress/core/pkg/ingress/annotations/ipwhitelist"
+	"k8s.io/ingress/core/pkg/ingress/annotations/rewrite"
+	"k8s.io/ingress/core/pkg/ingress/defaults"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+)
+
+const (
+	conflictPolicyOldest = "oldest"
+	conflictPolicyReject = "reject"
+	// defaultBackendName is the name used by the ingress core for the default backend
+	defaultBackendName = "upstream-default-backend"
+)
+
+// conflictResolver resolves the default backend and secrets used to
+// parse the annotations of the ingress which wins a conflict
+type conflictResolver struct {
+	anns     *ingressAnnotations
+	defaults defaults.Backend
+}
+
+func (r *conflictResolver) GetDefaultBackend() defaults.Backend {
+	return r.defaults
+}
+
+func (r *conflictResolver) GetSecret(name string) (*api.Secret, error) {
+	obj, exists, err := r.anns.lister.Secret.GetByKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("secret %v was not found", name)
+	}
+	return obj.(*api.Secret), nil
+}
+
+// applyConflictPolicy handles locations, hostname and path, declared by more than
+// one ingress resource. The ingress core uses the location of the ingress with
+// the lowest resource version, which changes on every update of the resource.
+// Policy `oldest` uses the oldest ingress instead, and policy `reject` uses the
+// default backend, so the conflict should be fixed by the owners of the ingresses.
+func applyConflictPolicy(cfg *ingress.Configuration, anns *ingressAnnotations, policy string, def defaults.Backend) {
+	if policy == "" {
+		policy = conflictPolicyOldest
+	}
+	if policy != conflictPolicyOldest && policy != conflictPolicyReject {
+		glog.Warningf("invalid conflict policy '%v', using '%v'", policy, conflictPolicyOldest)
+		policy = conflictPolicyOldest
+	}
+	backendNames := make(map[string]bool, len(cfg.Backends))
+	for _, backend := range cfg.Backends {
+		backendNames[backend.Name] = true
+	}
+	resolver := &conflictResolver{anns: anns, defaults: def}
+	for _, server := range cfg.Servers {
+		for _, location := range server.Locations {
+			claims := anns.locationClaims(server.Hostname, location.Path)
+			if len(claims) < 2 {
+				continue
+			}
+			oldest := claims[0]
+			for _, claim := range claims[1:] {
+				glog.Warningf("location %v%v of ingress %v/%v conflicts with ingress %v/%v, applying policy '%v'",
+					server.Hostname, location.Path, claim.ingress.Namespace, claim.ingress.Name,
+					oldest.ingress.Namespace, oldest.ingress.Name, policy)
+				anns.events.conflict(claim.ingress, "location %v%v conflicts with ingress %v/%v, applying policy '%v'",
+					server.Hostname, location.Path, oldest.ingress.Namespace, oldest.ingress.Name, policy)
+			}
+			if policy == conflictPolicyReject {
+				// the oldest ingress also loses its location
+				anns.events.conflict(oldest.ingress, "location %v%v conflicts with ingress %v/%v, applying policy '%v'",
+					server.Hostname, location.Path, claims[1].ingress.Namespace, claims[1].ingress.Name, policy)
+			}
+			if policy == conflictPolicyReject {
+				location.Backend = defaultBackendName
+				location.IsDefBackend = true
+				continue
+			}
+			if coreClaim(claims) == oldest {
+				continue
+			}
+			backendName := fmt.Sprintf("%v-%v-%v", oldest.ingress.Namespace, oldest.backend.ServiceName, oldest.backend.ServicePort.String())
+			if !backendNames[backendName] {
+				glog.Warningf("backend %v of ingress %v/%v was not found", backendName, oldest.ingress.Namespace, oldest.ingress.Name)
+				continue
+			}
+			location.Backend = backendName
+			updateLocation(location, oldest.ingress, resolver)
+		}
+	}
+}
+
+// coreClaim finds the ingress used by the ingress core on a conflicting location
+func coreClaim(claims []*locationClaim) *locationClaim {
+	claim := claims[0]
+	for _, c := range claims[1:] {
+		if c.ingress.ResourceVersion < claim.ingress.ResourceVersion {
+			claim = c
+		}
+	}
+	return claim
+}
+
+// updateLocation overwrites the annotations of a location, read by the ingress
+// core from another ingress, which are used by HAProxy Ingress
+func updateLocation(location *ingress.Location, ing *extensions.Ingress, resolver *conflictResolver) {
+	location.Denied = nil
+	location.Whitelist = ipwhitelist.SourceRange{}
+	if whitelist, err := ipwhitelist.NewParser(resolver).Parse(ing); err == nil {
+		location.Whitelist = *whitelist.(*ipwhitelist.SourceRange)
+	} else if whitelist != nil {
+		location.Whitelist = *whitelist.(*ipwhitelist.SourceRange)
+		location.Denied = err
+	}
+	location.Redirect = rewrite.Redirect{}
+	if redirect, err := rewrite.NewParser(resolver).Parse(ing); err == nil {
+		location.Redirect = *redirect.(*rewrite.Redirect)
+	}
+	location.BasicDigestAuth = auth.BasicDigest{}
+	if basicAuth, err := auth.NewParser(auth.AuthDirectory, resolver).Parse(ing); err == nil {
+		location.BasicDigestAuth = *basicAuth.(*auth.BasicDigest)
+	}
+}
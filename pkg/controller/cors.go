@@ -0,0 +1,127 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/golang/glog"
+	"regexp"
+	"sort"
+)
+
+// haproxyCORS has the CORS headers of a location. Name identifies the headers on
+// the frontends and is also the name of the backend which answers preflight requests,
+// locations with the same headers share the same name.
+type haproxyCORS struct {
+	Name              string
+	AllowOrigin       string
+	AllowMethods      string
+	AllowHeaders      string
+	AllowCredentials  bool
+	MaxAge            int
+	ErrorFile         string
+	ErrorFileChecksum string
+}
+
+// corsHeaderRegex restricts CORS options to characters which
+// can be used in a quoted argument and in a header value
+var corsHeaderRegex = regexp.MustCompile(`^[A-Za-z0-9 ,*:/._-]+$`)
+
+// newHAProxyCORS reads the cors-* annotations of a location with enable-cors
+func newHAProxyCORS(hostname string, location *haproxyLocation) *haproxyCORS {
+	def := newDefaultLocationConfig()
+	cors := &haproxyCORS{
+		AllowOrigin:      location.CORSAllowOrigin,
+		AllowMethods:     location.CORSAllowMethods,
+		AllowHeaders:     location.CORSAllowHeaders,
+		AllowCredentials: location.CORSAllowCredentials,
+		MaxAge:           location.CORSMaxAge,
+	}
+	for _, option := range []struct {
+		name  string
+		value *string
+		def   string
+	}{
+		{"cors-allow-origin", &cors.AllowOrigin, def.CORSAllowOrigin},
+		{"cors-allow-methods", &cors.AllowMethods, def.CORSAllowMethods},
+		{"cors-allow-headers", &cors.AllowHeaders, def.CORSAllowHeaders},
+	} {
+		if !corsHeaderRegex.MatchString(*option.value) {
+			glog.Warningf("invalid %v of %v%v, using %v: %v", option.name, hostname, location.Path, option.def, *option.value)
+			*option.value = option.def
+		}
+	}
+	if cors.MaxAge < 0 {
+		cors.MaxAge = def.CORSMaxAge
+	}
+	cors.Name = fmt.Sprintf("cors-%x", sha1.Sum([]byte(cors.preflightHeader())))[:15]
+	return cors
+}
+
+// preflightHeader is the response of a preflight request, saved as the
+// errorfile of a backend without servers, which HAProxy sends as is
+func (c *haproxyCORS) preflightHeader() string {
+	header := "HTTP/1.0 204 No Content\r\n" +
+		"Access-Control-Allow-Origin: " + c.AllowOrigin + "\r\n" +
+		"Access-Control-Allow-Methods: " + c.AllowMethods + "\r\n" +
+		"Access-Control-Allow-Headers: " + c.AllowHeaders + "\r\n"
+	if c.AllowCredentials {
+		header = header + "Access-Control-Allow-Credentials: true\r\n"
+	}
+	return header +
+		fmt.Sprintf("Access-Control-Max-Age: %v\r\n", c.MaxAge) +
+		"Content-Length: 0\r\n" +
+		"Connection: close\r\n" +
+		"\r\n"
+}
+
+// corsBackends lists the CORS configurations of all the locations, without
+// duplicates, and saves their preflight responses
+func corsBackends(serverLists ...[]*haproxyServer) []*haproxyCORS {
+	backends := map[string]*haproxyCORS{}
+	for _, servers := range serverLists {
+		for _, server := range servers {
+			if server == nil {
+				continue
+			}
+			for _, location := range server.Locations {
+				if location.HACORS != nil {
+					backends[location.HACORS.Name] = location.HACORS
+				}
+			}
+		}
+	}
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	corsList := make([]*haproxyCORS, 0, len(names))
+	for _, name := range names {
+		cors := backends[name]
+		fileName, checksum, err := writeErrorFile(name, cors.preflightHeader(), "")
+		if err != nil {
+			glog.Warningf("error saving CORS preflight response: %v", err)
+		} else {
+			cors.ErrorFile = fileName
+			cors.ErrorFileChecksum = checksum
+		}
+		corsList = append(corsList, cors)
+	}
+	return corsList
+}
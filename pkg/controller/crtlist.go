@@ -0,0 +1,166 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// crtListFileName is where the crt-list of the hostnames which share
+// the same TLS frontend is saved
+var crtListFileName = "/usr/local/etc/haproxy/crt-list.txt"
+
+// crtListFrontend is the name of the TLS frontend of the crt-list hostnames
+const crtListFrontend = "crt-list"
+
+// sslCiphersRegex restricts the ssl-ciphers annotation to the
+// characters used by the OpenSSL cipher list format
+var sslCiphersRegex = regexp.MustCompile(`^[A-Za-z0-9_:+!@=.-]+$`)
+
+// haproxyHTTPSFrontend terminates the TLS connections of its hostnames, sent
+// by the HTTPS frontend, which routes on the SNI extension. Hostnames have a
+// frontend of their own, whose TLS options are declared on the bind line, or
+// share the crt-list frontend, whose TLS options are declared per hostname
+// on the CrtList file.
+type haproxyHTTPSFrontend struct {
+	Name            string
+	CrtList         string
+	CrtListChecksum string
+	Servers         []*haproxyServer
+	HACanaryCookie  bool
+}
+
+// assignSSLCiphers configures the ciphers of the HTTPS hostnames. The ssl-ciphers
+// annotation of any ingress of a hostname overrides the global ciphers.
+func assignSSLCiphers(servers []*haproxyServer) {
+	for _, server := range servers {
+		for _, location := range server.Locations {
+			if location.SSLCiphers == "" {
+				continue
+			}
+			if !sslCiphersRegex.MatchString(location.SSLCiphers) {
+				glog.Warningf("invalid ssl-ciphers value of hostname %v: %v", server.Hostname, location.SSLCiphers)
+				continue
+			}
+			server.HASSLCiphers = location.SSLCiphers
+			break
+		}
+	}
+}
+
+// newHTTPSFrontends builds the TLS frontends of the HTTPS hostnames. If crtList
+// is true, hostnames share a single frontend whose certificates and TLS options
+// are read from a crt-list. Hostnames with an optional client certificate need
+// to ignore verification errors, which is only supported on the bind line, so
+// they keep a frontend of their own.
+func newHTTPSFrontends(crtList bool, servers []*haproxyServer) []*haproxyHTTPSFrontend {
+	frontends := []*haproxyHTTPSFrontend{}
+	var shared []*haproxyServer
+	if crtList {
+		for _, server := range servers {
+			if !server.HACAOptional {
+				shared = append(shared, server)
+			}
+		}
+	}
+	if len(shared) > 0 {
+		fileName, checksum, err := writeCrtList(shared)
+		if err != nil {
+			glog.Warningf("error writing the crt-list, using a frontend per hostname: %v", err)
+			shared = nil
+		} else {
+			frontend := &haproxyHTTPSFrontend{
+				Name:            crtListFrontend,
+				CrtList:         fileName,
+				CrtListChecksum: checksum,
+				Servers:         shared,
+			}
+			for _, server := range shared {
+				server.HACrtList = true
+				server.HAMatchSNI = " { ssl_fc_sni -i " + server.Hostname + " }"
+				if server.HACanaryCookie {
+					frontend.HACanaryCookie = true
+				}
+			}
+			frontends = append(frontends, frontend)
+		}
+	}
+	for _, server := range servers {
+		for _, location := range server.Locations {
+			location.HAMatchHTTPS = server.HAMatchSNI + location.HAMatchPath
+		}
+		if server.HACrtList {
+			continue
+		}
+		frontends = append(frontends, &haproxyHTTPSFrontend{
+			Name:           server.Hostname,
+			Servers:        []*haproxyServer{server},
+			HACanaryCookie: server.HACanaryCookie,
+		})
+	}
+	return frontends
+}
+
+// crtListEntry is the line of a hostname on the crt-list: the certificate,
+// the TLS options of the hostname, and the hostname as the SNI filter
+func crtListEntry(server *haproxyServer) string {
+	var options []string
+	if server.HTTP2 {
+		options = append(options, "alpn h2,http/1.1")
+	}
+	if server.HASSLCiphers != "" {
+		options = append(options, "ciphers "+server.HASSLCiphers)
+	}
+	if server.HACAFile != "" {
+		options = append(options, "ca-file "+server.HACAFile, "verify required")
+	}
+	entry := server.SSLCertificate
+	if len(options) > 0 {
+		entry += " [" + strings.Join(options, " ") + "]"
+	}
+	return entry + " " + server.Hostname
+}
+
+// writeCrtList saves the crt-list of the servers. The file is only rewritten if
+// its content changed. HAProxy reads the crt-list on startup, so the returned
+// checksum should be added to the configuration in order to force a reload.
+func writeCrtList(servers []*haproxyServer) (fileName string, checksum string, err error) {
+	var content bytes.Buffer
+	for _, server := range servers {
+		content.WriteString(crtListEntry(server) + "\n")
+	}
+	fileName = crtListFileName
+	checksum = fmt.Sprintf("%x", sha1.Sum(content.Bytes()))
+	if current, err := ioutil.ReadFile(fileName); err == nil && bytes.Equal(current, content.Bytes()) {
+		return fileName, checksum, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(fileName, content.Bytes(), 0644); err != nil {
+		return "", "", err
+	}
+	return fileName, checksum, nil
+}
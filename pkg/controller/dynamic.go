@@ -0,0 +1,186 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/golang/glog"
+	"regexp"
+	"strings"
+)
+
+// slotTracker assigns the endpoints of backends using dynamic scaling to
+// server slots. Endpoints keep their slots between syncs, so only added
+// and removed endpoints need to be changed on HAProxy.
+type slotTracker struct {
+	slots map[string][]string
+}
+
+func newSlotTracker() *slotTracker {
+	return &slotTracker{
+		slots: map[string][]string{},
+	}
+}
+
+// assign fills the slots of the backends using dynamic scaling. The number
+// of slots is a multiple of the slots increment, and is only reduced if more
+// than one increment is unused.
+func (t *slotTracker) assign(backends []*haproxyBackend) {
+	slots := make(map[string][]string, len(backends))
+	for _, backend := range backends {
+		if !backend.DynamicScaling {
+			continue
+		}
+		increment := backend.SlotsIncrement
+		if increment <= 0 {
+			increment = 1
+		}
+		endpoints := make(map[string]*haproxyEndpoint, len(backend.HAEndpoints))
+		for _, endpoint := range backend.HAEndpoints {
+			endpoints[endpointTarget(endpoint)] = endpoint
+		}
+		size := ((len(endpoints) + increment - 1) / increment) * increment
+		if size == 0 {
+			size = increment
+		}
+		current := t.slots[backend.Name]
+		if len(current) > size && len(current) <= size+increment {
+			size = len(current)
+		}
+		targets := make([]string, size)
+		assigned := map[string]bool{}
+		for i, target := range current {
+			if _, found := endpoints[target]; found && i < size {
+				targets[i] = target
+				assigned[target] = true
+			}
+		}
+		next := 0
+		for _, endpoint := range backend.HAEndpoints {
+			target := endpointTarget(endpoint)
+			if assigned[target] {
+				continue
+			}
+			for targets[next] != "" {
+				next++
+			}
+			targets[next] = target
+			assigned[target] = true
+		}
+		backend.HASlots = make([]*haproxySlot, size)
+		for i, target := range targets {
+			backend.HASlots[i] = &haproxySlot{
+				Name:     fmt.Sprintf("srv%03d", i+1),
+				Endpoint: endpoints[target],
+			}
+		}
+		slots[backend.Name] = targets
+	}
+	t.slots = slots
+}
+
+func endpointTarget(endpoint *haproxyEndpoint) string {
+	return endpoint.Address + ":" + endpoint.Port
+}
+
+var (
+	backendLineRegex = regexp.MustCompile(`^backend (\S+)`)
+	slotLineRegex    = regexp.MustCompile(`^\s+server (srv[0-9]+) (\S+)(.*)$`)
+)
+
+type slotLine struct {
+	target   string
+	disabled bool
+	options  string
+}
+
+// parseSlots splits a configuration into the server slots, keyed by
+// <backend>/<server>, and all the remaining lines
+func parseSlots(data []byte) (string, map[string]*slotLine) {
+	var rest bytes.Buffer
+	slots := map[string]*slotLine{}
+	backend := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := backendLineRegex.FindStringSubmatch(line); match != nil {
+			backend = match[1]
+		}
+		match := slotLineRegex.FindStringSubmatch(line)
+		if match == nil || backend == "" {
+			rest.WriteString(line + "\n")
+			continue
+		}
+		options := match[3]
+		disabled := strings.HasPrefix(options, " disabled")
+		options = strings.TrimPrefix(options, " disabled")
+		slots[backend+"/"+match[1]] = &slotLine{
+			target:   match[2],
+			disabled: disabled,
+			options:  options,
+		}
+	}
+	return rest.String(), slots
+}
+
+// dynamicUpdate applies the changes between two configurations using the
+// HAProxy admin socket. It's only possible if the configurations differ just
+// on the addresses and state of server slots, otherwise HAProxy should be
+// reloaded and false is returned.
+func dynamicUpdate(socket string, current, updated []byte) bool {
+	currentRest, currentSlots := parseSlots(current)
+	updatedRest, updatedSlots := parseSlots(updated)
+	if currentRest != updatedRest || len(currentSlots) != len(updatedSlots) {
+		return false
+	}
+	commands := []string{}
+	for name, updatedSlot := range updatedSlots {
+		currentSlot, found := currentSlots[name]
+		if !found || currentSlot.options != updatedSlot.options {
+			return false
+		}
+		if *currentSlot == *updatedSlot {
+			continue
+		}
+		if updatedSlot.disabled {
+			commands = append(commands, fmt.Sprintf("set server %v state maint", name))
+			continue
+		}
+		target := strings.Split(updatedSlot.target, ":")
+		if len(target) != 2 {
+			return false
+		}
+		commands = append(commands,
+			fmt.Sprintf("set server %v addr %v port %v", name, target[0], target[1]),
+			fmt.Sprintf("set server %v state ready", name))
+	}
+	for _, command := range commands {
+		out, err := socketCommand(socket, command)
+		if err != nil {
+			glog.Warningf("error sending '%v' to HAProxy: %v", command, err)
+			return false
+		}
+		if msg := strings.TrimSpace(string(out)); msg != "" && !strings.HasPrefix(msg, "IP changed") && !strings.HasPrefix(msg, "no need to change") {
+			glog.Warningf("unexpected output of '%v': %v", command, msg)
+			return false
+		}
+	}
+	glog.Infof("HAProxy updated without reload, %v command(s) sent", len(commands))
+	return true
+}
@@ -0,0 +1,359 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"k8s.io/ingress/core/pkg/ingress"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newDynamicBackend(name string, increment int, targets ...string) *haproxyBackend {
+	endpoints := make([]*haproxyEndpoint, len(targets))
+	for i, target := range targets {
+		addr := strings.Split(target, ":")
+		endpoints[i] = &haproxyEndpoint{
+			Endpoint: ingress.Endpoint{Address: addr[0], Port: addr[1]},
+		}
+	}
+	return &haproxyBackend{
+		Backend: &ingress.Backend{Name: name},
+		backendConfig: backendConfig{
+			DynamicScaling: true,
+			SlotsIncrement: increment,
+		},
+		HAEndpoints: endpoints,
+	}
+}
+
+func slotTargets(backend *haproxyBackend) []string {
+	targets := make([]string, len(backend.HASlots))
+	for i, slot := range backend.HASlots {
+		if slot.Name != fmt.Sprintf("srv%03d", i+1) {
+			return nil
+		}
+		if slot.Endpoint != nil {
+			targets[i] = endpointTarget(slot.Endpoint)
+		}
+	}
+	return targets
+}
+
+func TestSlotTrackerAssign(t *testing.T) {
+	// every step is a sync of the same backend, slots of the previous
+	// steps are kept by the tracker
+	testCases := []struct {
+		increment int
+		endpoints []string
+		expected  []string
+	}{
+		// 0: first sync, size is a multiple of the increment
+		{
+			increment: 4,
+			endpoints: []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"},
+			expected:  []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080", ""},
+		},
+		// 1: removed endpoint frees its slot, other endpoints don't move
+		{
+			increment: 4,
+			endpoints: []string{"10.0.0.1:8080", "10.0.0.3:8080"},
+			expected:  []string{"10.0.0.1:8080", "", "10.0.0.3:8080", ""},
+		},
+		// 2: added endpoint uses the first free slot
+		{
+			increment: 4,
+			endpoints: []string{"10.0.0.4:8080", "10.0.0.1:8080", "10.0.0.3:8080"},
+			expected:  []string{"10.0.0.1:8080", "10.0.0.4:8080", "10.0.0.3:8080", ""},
+		},
+		// 3: growing adds another increment
+		{
+			increment: 4,
+			endpoints: []string{"10.0.0.1:8080", "10.0.0.3:8080", "10.0.0.4:8080", "10.0.0.5:8080", "10.0.0.6:8080", "10.0.0.7:8080", "10.0.0.8:8080", "10.0.0.9:8080", "10.0.0.10:8080"},
+			expected:  []string{"10.0.0.1:8080", "10.0.0.4:8080", "10.0.0.3:8080", "10.0.0.5:8080", "10.0.0.6:8080", "10.0.0.7:8080", "10.0.0.8:8080", "10.0.0.9:8080", "10.0.0.10:8080", "", "", ""},
+		},
+		// 4: a single unused increment is kept
+		{
+			increment: 4,
+			endpoints: []string{"10.0.0.1:8080", "10.0.0.3:8080", "10.0.0.4:8080", "10.0.0.5:8080", "10.0.0.6:8080"},
+			expected:  []string{"10.0.0.1:8080", "10.0.0.4:8080", "10.0.0.3:8080", "10.0.0.5:8080", "10.0.0.6:8080", "", "", "", "", "", "", ""},
+		},
+		// 5: shrinking moves endpoints of the removed slots to free slots
+		{
+			increment: 4,
+			endpoints: []string{"10.0.0.9:8080", "10.0.0.3:8080"},
+			expected:  []string{"10.0.0.9:8080", "", "10.0.0.3:8080", ""},
+		},
+		// 6: no endpoint still has an increment of slots
+		{
+			increment: 4,
+			endpoints: []string{},
+			expected:  []string{"", "", "", ""},
+		},
+		// 7: invalid increment uses one slot per endpoint
+		{
+			increment: 0,
+			endpoints: []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+			expected:  []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+		},
+	}
+	tracker := newSlotTracker()
+	for i, test := range testCases {
+		backend := newDynamicBackend("default-app-8080", test.increment, test.endpoints...)
+		tracker.assign([]*haproxyBackend{backend})
+		if targets := slotTargets(backend); !reflect.DeepEqual(targets, test.expected) {
+			t.Errorf("%d: expected slots %q, found %q", i, test.expected, targets)
+		}
+	}
+}
+
+func TestSlotTrackerAssignBackends(t *testing.T) {
+	tracker := newSlotTracker()
+	static := newDynamicBackend("default-static-8080", 4, "10.0.0.1:8080")
+	static.DynamicScaling = false
+	app1 := newDynamicBackend("default-app1-8080", 2, "10.0.0.2:8080", "10.0.0.3:8080")
+	app2 := newDynamicBackend("default-app2-8080", 2, "10.0.0.4:8080")
+	tracker.assign([]*haproxyBackend{static, app1, app2})
+	if static.HASlots != nil {
+		t.Errorf("expected no slot on a backend without dynamic scaling, found %v", len(static.HASlots))
+	}
+	// app1 is removed, its slots shouldn't be used if it's added again
+	app2 = newDynamicBackend("default-app2-8080", 2, "10.0.0.5:8080", "10.0.0.4:8080")
+	tracker.assign([]*haproxyBackend{app2})
+	if _, found := tracker.slots["default-app1-8080"]; found {
+		t.Errorf("expected slots of a removed backend to be discarded")
+	}
+	expected := []string{"10.0.0.4:8080", "10.0.0.5:8080"}
+	if targets := slotTargets(app2); !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected slots %q, found %q", expected, targets)
+	}
+	app1 = newDynamicBackend("default-app1-8080", 2, "10.0.0.3:8080")
+	tracker.assign([]*haproxyBackend{app1, app2})
+	expected = []string{"10.0.0.3:8080", ""}
+	if targets := slotTargets(app1); !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected slots %q, found %q", expected, targets)
+	}
+}
+
+const dynamicConfig = `global
+    daemon
+backend default-app-8080
+    mode http
+    server srv001 10.0.0.1:8080 check inter 2s weight 1
+    server srv002 127.0.0.1:1 disabled check inter 2s
+backend default-web-8080
+    mode http
+    server 10.0.0.9:8080 10.0.0.9:8080 check inter 2s
+    server srv001 10.0.0.2:8080 check inter 2s
+`
+
+func TestParseSlots(t *testing.T) {
+	rest, slots := parseSlots([]byte(dynamicConfig))
+	expectedRest := `global
+    daemon
+backend default-app-8080
+    mode http
+backend default-web-8080
+    mode http
+    server 10.0.0.9:8080 10.0.0.9:8080 check inter 2s
+`
+	if rest != expectedRest {
+		t.Errorf("expected remaining lines:\n%v\nfound:\n%v", expectedRest, rest)
+	}
+	expectedSlots := map[string]*slotLine{
+		"default-app-8080/srv001": {target: "10.0.0.1:8080", options: " check inter 2s weight 1"},
+		"default-app-8080/srv002": {target: "127.0.0.1:1", disabled: true, options: " check inter 2s"},
+		"default-web-8080/srv001": {target: "10.0.0.2:8080", options: " check inter 2s"},
+	}
+	if len(slots) != len(expectedSlots) {
+		t.Errorf("expected %v slots, found %v", len(expectedSlots), len(slots))
+	}
+	for name, expected := range expectedSlots {
+		slot, found := slots[name]
+		if !found {
+			t.Errorf("expected slot %v was not found", name)
+			continue
+		}
+		if *slot != *expected {
+			t.Errorf("expected slot %v to be %+v, found %+v", name, *expected, *slot)
+		}
+	}
+}
+
+func TestParseSlotsIndentation(t *testing.T) {
+	for i, indent := range []string{"  ", "    ", "\t", "\t  "} {
+		_, slots := parseSlots([]byte("backend default-app-8080\n" + indent + "server srv001 10.0.0.1:8080 check\n"))
+		slot, found := slots["default-app-8080/srv001"]
+		if !found || slot.target != "10.0.0.1:8080" {
+			t.Errorf("%d: expected slot srv001 with indentation %q", i, indent)
+		}
+	}
+}
+
+// fakeSocket is a HAProxy admin socket which saves the commands and
+// answers all of them with the same output
+type fakeSocket struct {
+	path     string
+	output   string
+	listener net.Listener
+	mutex    sync.Mutex
+	commands []string
+}
+
+func newFakeSocket(t *testing.T, output string) *fakeSocket {
+	dir, err := ioutil.TempDir("", "haproxy-socket")
+	if err != nil {
+		t.Fatalf("error creating the socket dir: %v", err)
+	}
+	path := filepath.Join(dir, "admin.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("error listening on %v: %v", path, err)
+	}
+	socket := &fakeSocket{path: path, output: output, listener: listener}
+	go socket.serve()
+	return socket
+}
+
+func (s *fakeSocket) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		command, _ := bufio.NewReader(conn).ReadString('\n')
+		s.mutex.Lock()
+		s.commands = append(s.commands, strings.TrimSpace(command))
+		s.mutex.Unlock()
+		conn.Write([]byte(s.output))
+		conn.Close()
+	}
+}
+
+func (s *fakeSocket) close() []string {
+	s.listener.Close()
+	os.RemoveAll(filepath.Dir(s.path))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.commands
+}
+
+func TestDynamicUpdate(t *testing.T) {
+	testCases := []struct {
+		updated  string
+		output   string
+		expected bool
+		commands []string
+	}{
+		// 0: same configuration
+		{
+			updated:  dynamicConfig,
+			expected: true,
+			commands: []string{},
+		},
+		// 1: enabled slot with another endpoint
+		{
+			updated:  strings.Replace(dynamicConfig, "srv001 10.0.0.2:8080", "srv001 10.0.0.3:8080", 1),
+			expected: true,
+			commands: []string{
+				"set server default-web-8080/srv001 addr 10.0.0.3 port 8080",
+				"set server default-web-8080/srv001 state ready",
+			},
+		},
+		// 2: disabled slot with an endpoint
+		{
+			updated:  strings.Replace(dynamicConfig, "srv002 127.0.0.1:1 disabled", "srv002 10.0.0.4:8080", 1),
+			expected: true,
+			commands: []string{
+				"set server default-app-8080/srv002 addr 10.0.0.4 port 8080",
+				"set server default-app-8080/srv002 state ready",
+			},
+		},
+		// 3: endpoint removed from a slot
+		{
+			updated:  strings.Replace(dynamicConfig, "srv001 10.0.0.1:8080 check inter 2s weight 1", "srv001 127.0.0.1:1 disabled check inter 2s weight 1", 1),
+			expected: true,
+			commands: []string{
+				"set server default-app-8080/srv001 state maint",
+			},
+		},
+		// 4: HAProxy output of a changed address is accepted
+		{
+			updated:  strings.Replace(dynamicConfig, "srv001 10.0.0.2:8080", "srv001 10.0.0.3:8080", 1),
+			output:   "IP changed from '10.0.0.2' to '10.0.0.3' by 'stats socket command'\n",
+			expected: true,
+			commands: []string{
+				"set server default-web-8080/srv001 addr 10.0.0.3 port 8080",
+				"set server default-web-8080/srv001 state ready",
+			},
+		},
+		// 5: other lines differ
+		{
+			updated:  strings.Replace(dynamicConfig, "daemon", "nbthread 2", 1),
+			expected: false,
+			commands: []string{},
+		},
+		// 6: server which isn't a slot differs
+		{
+			updated:  strings.Replace(dynamicConfig, "server 10.0.0.9:8080 10.0.0.9:8080", "server 10.0.0.8:8080 10.0.0.8:8080", 1),
+			expected: false,
+			commands: []string{},
+		},
+		// 7: options of a slot differ
+		{
+			updated:  strings.Replace(dynamicConfig, "weight 1", "weight 2", 1),
+			expected: false,
+			commands: []string{},
+		},
+		// 8: number of slots differ
+		{
+			updated:  strings.Replace(dynamicConfig, "    server srv001 10.0.0.2:8080 check inter 2s\n", "", 1),
+			expected: false,
+			commands: []string{},
+		},
+		// 9: HAProxy refuses the command
+		{
+			updated:  strings.Replace(dynamicConfig, "srv001 10.0.0.2:8080", "srv001 10.0.0.3:8080", 1),
+			output:   "No such server.\n",
+			expected: false,
+			commands: []string{
+				"set server default-web-8080/srv001 addr 10.0.0.3 port 8080",
+			},
+		},
+	}
+	for i, test := range testCases {
+		socket := newFakeSocket(t, test.output)
+		updated := dynamicUpdate(socket.path, []byte(dynamicConfig), []byte(test.updated))
+		commands := socket.close()
+		if updated != test.expected {
+			t.Errorf("%d: expected dynamic update %v, found %v", i, test.expected, updated)
+		}
+		if commands == nil {
+			commands = []string{}
+		}
+		if !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("%d: expected commands %q, found %q", i, test.commands, commands)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress/status"
+	client "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	"k8s.io/kubernetes/pkg/util/wait"
+	"os"
+	"sync"
+	"time"
+)
+
+// activePassive runs HAProxy only on the leader of the controller replicas.
+// Standby replicas keep syncing and rendering the configuration, so the
+// caches are warm and the last configuration is applied as soon as they
+// take over.
+type activePassive struct {
+	mutex      sync.Mutex
+	id         string
+	leading    bool
+	lastConfig []byte
+}
+
+func newActivePassive(haproxy *haproxyController, kubeClient *client.Clientset, electionID string) *activePassive {
+	podName := os.Getenv("POD_NAME")
+	podNamespace := os.Getenv("POD_NAMESPACE")
+	if podName == "" || podNamespace == "" {
+		glog.Fatalf("POD_NAME and POD_NAMESPACE environment variables are required on active-passive mode")
+	}
+	ap := &activePassive{
+		id: podName,
+	}
+	elector, err := status.NewElection(electionID, podName, podNamespace, 10*time.Second, func(leader string) {
+		ap.leaderChanged(haproxy, leader)
+	}, kubeClient)
+	if err != nil {
+		glog.Fatalf("error starting active-passive election: %v", err)
+	}
+	go elector.Run()
+	return ap
+}
+
+// leaderChanged applies the last configuration when this replica takes over.
+// A replica which loses the leadership exits, so it's restarted as a standby
+// replica without a running HAProxy.
+func (ap *activePassive) leaderChanged(haproxy *haproxyController, leader string) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+	if leader != ap.id {
+		if ap.leading {
+			glog.Fatalf("active-passive leadership lost, current leader: '%v'", leader)
+		}
+		glog.Infof("running as standby, current leader: '%v'", leader)
+		return
+	}
+	glog.Infof("running as active")
+	ap.leading = true
+	if ap.lastConfig != nil {
+		if _, _, err := haproxy.reload(ap.lastConfig); err != nil {
+			glog.Errorf("error applying the configuration: %v", err)
+		}
+	}
+}
+
+func (ap *activePassive) isLeading() bool {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+	return ap.leading
+}
+
+// reload only applies the configuration if this replica is the leader
+func (ap *activePassive) reload(haproxy *haproxyController, data []byte) ([]byte, bool, error) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+	ap.lastConfig = data
+	if !ap.leading {
+		return nil, false, nil
+	}
+	return haproxy.reload(data)
+}
+
+// clusterLeader joins the election of the replica which updates the ingress
+// status, so the same replica runs the cluster-scoped work, e.g. patching the
+// controller's service. Unlike the active-passive mode every replica runs
+// HAProxy, and a replica which loses the leadership keeps running.
+type clusterLeader struct {
+	mutex   sync.Mutex
+	id      string
+	leading bool
+}
+
+// newClusterLeader returns nil if POD_NAME or POD_NAMESPACE are missing,
+// a nil clusterLeader is always leading
+func newClusterLeader(kubeClient *client.Clientset, electionID string) *clusterLeader {
+	podName := os.Getenv("POD_NAME")
+	podNamespace := os.Getenv("POD_NAMESPACE")
+	if podName == "" || podNamespace == "" {
+		glog.Warningf("POD_NAME and POD_NAMESPACE are missing, cluster-scoped work will run on every replica")
+		return nil
+	}
+	cl := &clusterLeader{
+		id: podName,
+	}
+	// same ttl of the status update election, the lease duration is saved
+	// on the shared election record
+	elector, err := status.NewElection(electionID, podName, podNamespace, 30*time.Second, cl.leaderChanged, kubeClient)
+	if err != nil {
+		glog.Fatalf("error starting cluster leader election: %v", err)
+	}
+	go wait.Forever(elector.Run, 0)
+	return cl
+}
+
+func (cl *clusterLeader) leaderChanged(leader string) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.leading = leader == cl.id
+	if cl.leading {
+		glog.Infof("running cluster-scoped work")
+	} else {
+		glog.Infof("cluster-scoped work running on '%v'", leader)
+	}
+}
+
+func (cl *clusterLeader) isLeading() bool {
+	if cl == nil {
+		return true
+	}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.leading
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress"
+	"sort"
+	"time"
+)
+
+// endpointTracker remembers when every endpoint was seen for the last time,
+// so endpoints removed from a service can be kept on its backend during a
+// grace period, absorbing brief flaps without changing the configuration.
+type endpointTracker struct {
+	lastSeen map[string]map[ingress.Endpoint]time.Time
+}
+
+// placeholder used by the ingress core on backends without endpoints
+var emptyBackendEndpoint = ingress.Endpoint{Address: "127.0.0.1", Port: "8181"}
+
+func newEndpointTracker() *endpointTracker {
+	return &endpointTracker{
+		lastSeen: map[string]map[ingress.Endpoint]time.Time{},
+	}
+}
+
+// update adds to the backends the endpoints removed within the grace period.
+// Expired endpoints are removed on the first sync after the grace period.
+func (t *endpointTracker) update(backends []*ingress.Backend, gracePeriod string) {
+	grace := time.Duration(0)
+	if gracePeriod != "" {
+		if validTimeout(gracePeriod) {
+			grace = timeoutDuration(gracePeriod)
+		} else {
+			glog.Warningf("ignoring invalid endpoint grace period: %v", gracePeriod)
+		}
+	}
+	now := time.Now()
+	lastSeen := make(map[string]map[ingress.Endpoint]time.Time, len(backends))
+	for _, backend := range backends {
+		seen := map[ingress.Endpoint]time.Time{}
+		current := backend.Endpoints
+		if len(current) == 1 && current[0] == emptyBackendEndpoint {
+			current = nil
+		}
+		for _, endpoint := range current {
+			seen[endpoint] = now
+		}
+		var removed []ingress.Endpoint
+		for endpoint, when := range t.lastSeen[backend.Name] {
+			if _, found := seen[endpoint]; !found && now.Sub(when) < grace {
+				seen[endpoint] = when
+				removed = append(removed, endpoint)
+			}
+		}
+		if len(removed) > 0 {
+			glog.V(2).Infof("keeping %v removed endpoint(s) on backend %v during grace period", len(removed), backend.Name)
+			backend.Endpoints = append(current, removed...)
+			sort.Sort(ingress.EndpointByAddrPort(backend.Endpoints))
+		}
+		lastSeen[backend.Name] = seen
+	}
+	t.lastSeen = lastSeen
+}
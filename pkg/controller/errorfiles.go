@@ -0,0 +1,58 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// errorFilesDir is where HTML error pages read from ConfigMaps are saved as HAProxy errorfiles
+var errorFilesDir = "/usr/local/etc/haproxy/errors"
+
+// errorFileHeader is the status line and headers of an errorfile
+func errorFileHeader(status int) string {
+	return fmt.Sprintf("HTTP/1.0 %v %v\r\n", status, http.StatusText(status)) +
+		"Cache-Control: no-cache\r\n" +
+		"Connection: close\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n"
+}
+
+// writeErrorFile saves an errorfile with the given status line and headers followed by the HTML
+// page. The file is only rewritten if its content changed. HAProxy reads errorfiles on startup,
+// so the returned checksum should be added to the configuration in order to force a reload.
+func writeErrorFile(name, header, html string) (fileName string, checksum string, err error) {
+	content := []byte(header + html)
+	fileName = filepath.Join(errorFilesDir, name+".http")
+	checksum = fmt.Sprintf("%x", sha1.Sum(content))
+	if current, err := ioutil.ReadFile(fileName); err == nil && bytes.Equal(current, content) {
+		return fileName, checksum, nil
+	}
+	if err := os.MkdirAll(errorFilesDir, 0755); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(fileName, content, 0644); err != nil {
+		return "", "", err
+	}
+	return fileName, checksum, nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	client "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	unversionedcore "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/typed/core/internalversion"
+	"k8s.io/kubernetes/pkg/client/record"
+	"os"
+	"sync"
+)
+
+const (
+	eventReasonRenderFailed = "RenderFailed"
+	eventReasonReloadFailed = "ReloadFailed"
+	eventReasonConflict     = "LocationConflict"
+	eventReasonTCPExposed   = "TCPPortExposed"
+	eventReasonTCPRemoved   = "TCPPortRemoved"
+	// eventMaxOutput is the maximum size of the HAProxy output added to an event
+	eventMaxOutput = 1024
+)
+
+// eventReporter emits warning events on the pod of the controller when the
+// configuration cannot be applied, and on the ingress resources whose issues
+// can be tracked to them, so the failures are visible with kubectl describe
+type eventReporter struct {
+	recorder record.EventRecorder
+	pod      *api.Pod
+	mutex    sync.Mutex
+	failures map[string]string
+}
+
+func newEventReporter(kubeClient *client.Clientset) *eventReporter {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&unversionedcore.EventSinkImpl{
+		Interface: kubeClient.Core().Events(""),
+	})
+	events := &eventReporter{
+		failures: map[string]string{},
+		recorder: broadcaster.NewRecorder(api.EventSource{
+			Component: "haproxy-ingress",
+		}),
+	}
+	podName := os.Getenv("POD_NAME")
+	podNamespace := os.Getenv("POD_NAMESPACE")
+	if podName != "" && podNamespace != "" {
+		pod, err := kubeClient.Core().Pods(podNamespace).Get(podName)
+		if err != nil {
+			glog.Warningf("events won't be emitted on the controller pod: %v", err)
+		} else {
+			events.pod = pod
+		}
+	} else {
+		glog.Warningf("events won't be emitted on the controller pod, POD_NAME and POD_NAMESPACE are missing")
+	}
+	return events
+}
+
+func (e *eventReporter) renderFailed(err error) {
+	e.failed(eventReasonRenderFailed, fmt.Sprintf("error rendering the HAProxy configuration: %v", err))
+}
+
+func (e *eventReporter) renderSucceeded() {
+	e.succeeded(eventReasonRenderFailed)
+}
+
+func (e *eventReporter) reloadFailed(out []byte, err error) {
+	output := string(out)
+	if len(output) > eventMaxOutput {
+		output = output[:eventMaxOutput] + "..."
+	}
+	e.failed(eventReasonReloadFailed, fmt.Sprintf("error reloading HAProxy: %v\n%v", err, output))
+}
+
+func (e *eventReporter) reloadSucceeded() {
+	e.succeeded(eventReasonReloadFailed)
+}
+
+// failed emits a warning event on the controller pod, unless the same failure
+// was already reported and didn't succeed since then, so a failure repeated on
+// every sync emits a single event
+func (e *eventReporter) failed(reason, message string) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.failures[reason] == message {
+		return
+	}
+	e.failures[reason] = message
+	e.podEvent(api.EventTypeWarning, reason, "%v", message)
+}
+
+func (e *eventReporter) succeeded(reason string) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.failures, reason)
+}
+
+// conflict emits a warning event on an ingress whose location, hostname and
+// path, isn't used due to a conflict with another ingress
+func (e *eventReporter) conflict(ing *extensions.Ingress, messageFmt string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+	e.recorder.Eventf(ing, api.EventTypeWarning, eventReasonConflict, messageFmt, args...)
+}
+
+func (e *eventReporter) tcpPortExposed(port int, service string) {
+	e.podEvent(api.EventTypeNormal, eventReasonTCPExposed, "exposing TCP port %v to service %v", port, service)
+}
+
+func (e *eventReporter) tcpPortRemoved(port int, service string) {
+	e.podEvent(api.EventTypeNormal, eventReasonTCPRemoved, "removing TCP port %v of service %v", port, service)
+}
+
+// podEvent emits an event on the controller pod
+func (e *eventReporter) podEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if e == nil || e.pod == nil {
+		return
+	}
+	e.recorder.Eventf(e.pod, eventType, reason, messageFmt, args...)
+}
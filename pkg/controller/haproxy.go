@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"github.com/golang/glog"
 	"github.com/jcmoraisjr/haproxy-ingress/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/pflag"
 	"io/ioutil"
 	"k8s.io/ingress/core/pkg/ingress"
@@ -29,21 +30,75 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type haproxyController struct {
-	controller *controller.GenericController
-	configMap  *api.ConfigMap
-	command    string
-	configFile string
-	template   *template
+	controller        *controller.GenericController
+	configMap         *api.ConfigMap
+	storeLister       *ingress.StoreLister
+	command           string
+	configFile        string
+	configMutex       sync.Mutex
+	configChecksum    string
+	splitConfig       bool
+	configFiles       []string
+	dryRun            bool
+	dryRunOutput      string
+	statsSocket       string
+	pidFile           string
+	drainTimeout      time.Duration
+	apiPort           int
+	flags             *pflag.FlagSet
+	patchTCPSvc       string
+	svcPatcher        *servicePatcher
+	classConfig       *controller.Configuration
+	electionID        string
+	ha                *activePassive
+	leader            *clusterLeader
+	acmeServer        string
+	acmeEmail         string
+	acmeAccountSecret string
+	acmePort          int
+	acme              *acmeManager
+	metrics           *controllerMetrics
+	watchPodWeights   bool
+	pods              *podWeights
+	reportEvents      bool
+	watchNamespaces   string
+	watchNsSelector   string
+	namespaces        *namespaceFilter
+	events            *eventReporter
+	statsdAddr        string
+	statsdPrefix      string
+	statsd            *statsdClient
+	reloadInterval    time.Duration
+	reloadBurst       int
+	throttle          *reloadThrottle
+	endpoints         *endpointTracker
+	slots             *slotTracker
+	streams           *streamTracker
+	applied           *statusTracker
+	template          *template
 }
 
 func newHAProxyController() *haproxyController {
 	return &haproxyController{
-		command:    "/haproxy-wrapper",
-		configFile: "/usr/local/etc/haproxy/haproxy.cfg",
-		template:   newTemplate("haproxy.tmpl", "/usr/local/etc/haproxy/haproxy.tmpl"),
+		command:     "/haproxy-wrapper",
+		configFile:  "/usr/local/etc/haproxy/haproxy.cfg",
+		statsSocket: "/tmp/haproxy",
+		pidFile:     "/var/run/haproxy.pid",
+		endpoints:   newEndpointTracker(),
+		slots:       newSlotTracker(),
+		streams:     newStreamTracker(),
+		applied:     newStatusTracker(),
+		metrics:     newControllerMetrics(),
+		template:    newTemplate("haproxy.tmpl", "/usr/local/etc/haproxy/haproxy.tmpl"),
 	}
 }
 
@@ -57,16 +112,117 @@ func (haproxy *haproxyController) Info() *ingress.BackendInfo {
 }
 
 func (haproxy *haproxyController) Start() {
-	controller := controller.NewIngressController(haproxy)
-	haproxy.controller = controller
+	prometheus.MustRegister(newBackendCollector(haproxy.statsSocket))
+	prometheus.MustRegister(newCacheCollector(haproxy))
+	haproxy.metrics.register()
+	haproxy.controller = controller.NewIngressController(haproxy)
+	haproxy.classConfig = &controller.Configuration{
+		IngressClass:        haproxy.flags.Lookup("ingress-class").Value.String(),
+		DefaultIngressClass: haproxy.DefaultIngressClass(),
+	}
+	if haproxy.dryRun {
+		haproxy.controller.Start()
+		return
+	}
+	if haproxy.reloadInterval > 0 {
+		haproxy.throttle = newReloadThrottle(haproxy.reloadInterval, haproxy.reloadBurst, &haproxy.configMutex)
+	}
+	if haproxy.statsdAddr != "" {
+		statsd, err := newStatsdClient(haproxy.statsdAddr, haproxy.statsdPrefix)
+		if err != nil {
+			glog.Fatalf("error configuring statsd: %v", err)
+		}
+		haproxy.statsd = statsd
+	}
+	if haproxy.patchTCPSvc != "" || haproxy.electionID != "" || haproxy.acmeServer != "" || haproxy.watchPodWeights || haproxy.reportEvents ||
+		haproxy.watchNamespaces != "" || haproxy.watchNsSelector != "" {
+		kubeClient, err := newKubeClient(haproxy.flags)
+		if err != nil {
+			glog.Fatalf("error creating the kubernetes client: %v", err)
+		}
+		if haproxy.patchTCPSvc != "" {
+			svcPatcher, err := newServicePatcher(kubeClient, haproxy.patchTCPSvc)
+			if err != nil {
+				glog.Fatalf("error configuring the service patcher: %v", err)
+			}
+			haproxy.svcPatcher = svcPatcher
+		}
+		if haproxy.electionID != "" {
+			haproxy.ha = newActivePassive(haproxy, kubeClient, haproxy.electionID)
+		}
+		if haproxy.patchTCPSvc != "" || (haproxy.acmeServer != "" && haproxy.ha == nil) {
+			haproxy.leader = newClusterLeader(kubeClient, haproxy.flags.Lookup("election-id").Value.String())
+		}
+		if haproxy.acmeServer != "" {
+			acme, err := newAcmeManager(kubeClient, haproxy.acmeServer, haproxy.acmeEmail, haproxy.acmeAccountSecret, haproxy.acmePort)
+			if err != nil {
+				glog.Fatalf("error configuring ACME: %v", err)
+			}
+			haproxy.acme = acme
+			go acme.startSolver()
+		}
+		if haproxy.watchPodWeights {
+			resyncPeriod, _ := haproxy.flags.GetDuration("sync-period")
+			haproxy.pods = newPodWeights(kubeClient, haproxy.flags.Lookup("watch-namespace").Value.String(), resyncPeriod)
+			go haproxy.pods.run()
+		}
+		if haproxy.reportEvents {
+			haproxy.events = newEventReporter(kubeClient)
+			haproxy.streams.events = haproxy.events
+		}
+		if haproxy.watchNamespaces != "" || haproxy.watchNsSelector != "" {
+			resyncPeriod, _ := haproxy.flags.GetDuration("sync-period")
+			namespaces, err := newNamespaceFilter(kubeClient, haproxy.watchNamespaces, haproxy.watchNsSelector, resyncPeriod)
+			if err != nil {
+				glog.Fatalf("error configuring the watched namespaces: %v", err)
+			}
+			haproxy.namespaces = namespaces
+			go namespaces.run()
+		}
+	}
+	go haproxy.startAPI()
 	haproxy.controller.Start()
 }
 
 func (haproxy *haproxyController) Stop() error {
 	err := haproxy.controller.Stop()
+	haproxy.drainHaproxy()
 	return err
 }
 
+// drainHaproxy soft stops HAProxy and waits the running requests to finish,
+// up to drain-timeout. HAProxy stops listening and its master process exits
+// as soon as every worker has finished its connections.
+func (haproxy *haproxyController) drainHaproxy() {
+	if haproxy.drainTimeout <= 0 {
+		return
+	}
+	pidData, err := ioutil.ReadFile(haproxy.pidFile)
+	if err != nil {
+		// HAProxy wasn't started, e.g. a standby replica
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidData)))
+	if err != nil {
+		glog.Warningf("invalid HAProxy pid file: %v", err)
+		return
+	}
+	if err := syscall.Kill(pid, syscall.SIGUSR1); err != nil {
+		return
+	}
+	glog.Infof("draining HAProxy connections, waiting up to %v", haproxy.drainTimeout)
+	timeout := time.After(haproxy.drainTimeout)
+	for syscall.Kill(pid, 0) == nil {
+		select {
+		case <-timeout:
+			glog.Warningf("HAProxy still has running connections after %v", haproxy.drainTimeout)
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	glog.Infof("HAProxy connections drained")
+}
+
 func (haproxy *haproxyController) Name() string {
 	return "HAProxy Ingress Controller"
 }
@@ -76,13 +232,57 @@ func (haproxy *haproxyController) DefaultIngressClass() string {
 }
 
 func (haproxy *haproxyController) Check(_ *http.Request) error {
-	return nil
+	return haproxy.applied.check()
 }
 
-func (haproxy *haproxyController) SetListers(ingress.StoreLister) {
+func (haproxy *haproxyController) SetListers(lister ingress.StoreLister) {
+	haproxy.storeLister = &lister
 }
 
-func (haproxy *haproxyController) OverrideFlags(*pflag.FlagSet) {
+func (haproxy *haproxyController) OverrideFlags(flags *pflag.FlagSet) {
+	flags.IntVar(&haproxy.apiPort, "api-port", 0, `Port of the HAProxy Ingress API,
+		which exposes HAProxy runtime data, e.g. /tables and /tcp-services. Disabled by default`)
+	flags.StringVar(&haproxy.patchTCPSvc, "patch-tcp-service", "", `Service fronting the ingress
+		controllers, in the form namespace/name, whose ports should be kept in sync with the
+		TCP services ConfigMap. Disabled by default`)
+	flags.StringVar(&haproxy.electionID, "active-passive-election-id", "", `Election id of the
+		active-passive mode, where only the leader replica runs HAProxy. Disabled by default`)
+	flags.StringVar(&haproxy.statsdAddr, "statsd-address", "", `Address, host:port, of a StatsD
+		or DogStatsD server which should receive sync, reload and backend metrics. Disabled by default`)
+	flags.StringVar(&haproxy.statsdPrefix, "statsd-prefix", "haproxy_ingress", `Prefix of the
+		metric names sent to StatsD`)
+	flags.DurationVar(&haproxy.reloadInterval, "reload-interval", 0, `Minimum time between HAProxy
+		reloads. Updates received meanwhile are applied on a single reload. Disabled by default`)
+	flags.IntVar(&haproxy.reloadBurst, "reload-burst", 1, `Number of reloads allowed before
+		reload-interval starts to be applied`)
+	flags.BoolVar(&haproxy.splitConfig, "split-config", false, `Split the HAProxy configuration
+		into global, backends and frontends files, only changed files are rewritten`)
+	flags.BoolVar(&haproxy.dryRun, "dry-run", false, `Render the HAProxy configuration from the
+		cluster state, print it and exit without starting HAProxy`)
+	flags.StringVar(&haproxy.dryRunOutput, "dry-run-output", "", `File used to save the rendered
+		configuration on dry-run mode, default is the standard output`)
+	flags.DurationVar(&haproxy.drainTimeout, "drain-timeout", 25*time.Second, `Time to wait running
+		requests to finish when the controller is stopped, use a shorter time than
+		terminationGracePeriodSeconds of the pod. Use 0 to stop without draining`)
+	flags.StringVar(&haproxy.acmeServer, "acme-server", "", `Directory URL of an ACME server, e.g.
+		https://acme-v02.api.letsencrypt.org/directory, used to issue the certificates of
+		ingress resources with the acme annotation. ACME is disabled by default`)
+	flags.StringVar(&haproxy.acmeEmail, "acme-email", "", `Contact email of the ACME account`)
+	flags.StringVar(&haproxy.acmeAccountSecret, "acme-account-secret", "", `Secret, namespace/name,
+		used to store the private key of the ACME account. Created if it doesn't exist`)
+	flags.IntVar(&haproxy.acmePort, "acme-port", 10252, `Local port used to answer the ACME challenges`)
+	flags.BoolVar(&haproxy.watchPodWeights, "watch-pod-weights", false, `Watch the pods of the cluster and
+		use their ingress.kubernetes.io/weight annotation as the weight of their backend servers`)
+	flags.BoolVar(&haproxy.reportEvents, "report-events", false, `Emit warning events on the controller
+		pod when the configuration cannot be rendered or reloaded, and on the ingress resources whose
+		locations conflict with other ingresses. Changes on the exposed TCP ports are also emitted on
+		the controller pod`)
+	flags.StringVar(&haproxy.watchNamespaces, "watch-namespaces", "", `Comma-separated list of namespaces
+		whose ingress resources are used to build the configuration. All namespaces by default`)
+	flags.StringVar(&haproxy.watchNsSelector, "watch-namespaces-selector", "", `Label selector of the
+		namespaces whose ingress resources are used to build the configuration, added to the
+		ones of watch-namespaces`)
+	haproxy.flags = flags
 }
 
 func (haproxy *haproxyController) SetConfig(configMap *api.ConfigMap) {
@@ -90,41 +290,184 @@ func (haproxy *haproxyController) SetConfig(configMap *api.ConfigMap) {
 }
 
 func (haproxy *haproxyController) BackendDefaults() defaults.Backend {
-	def := newDefaultConfig()
+	var data map[string]string
 	if haproxy.configMap != nil {
-		mergeMap(haproxy.configMap.Data, &def)
+		data = haproxy.configMap.Data
 	}
-	return def
+	return newBackendDefaults(data)
 }
 
 func (haproxy *haproxyController) OnUpdate(cfg ingress.Configuration) ([]byte, error) {
-	var conf *configuration
+	start := time.Now()
+	var configMapData map[string]string
 	if haproxy.configMap != nil {
-		conf = newConfig(&cfg, haproxy.configMap.Data)
-	} else {
-		conf = newConfig(&cfg, nil)
+		configMapData = haproxy.configMap.Data
+	}
+	haproxy.endpoints.update(cfg.Backends, configMapData["endpoint-grace-period"])
+	anns := newIngressAnnotations(haproxy.storeLister, haproxy.classConfig, haproxy.namespaces)
+	if haproxy.namespaces != nil {
+		applyNamespaceFilter(&cfg, anns, haproxy.BackendDefaults())
+	}
+	anns.pods = haproxy.pods
+	anns.events = haproxy.events
+	tcpServices, tcpOptions := newExtendedTCPServices(anns, haproxy.flags.Lookup("tcp-services-configmap").Value.String())
+	cfg.TCPEndpoints = append(cfg.TCPEndpoints, tcpServices...)
+	conf := newConfig(&cfg, configMapData, anns)
+	conf.HATCPServiceOptions = tcpOptions
+	// TCP services are tracked after newConfig, which drops the ones using the http and https ports
+	haproxy.streams.update(conf.TCPEndpoints, conf.UDPEndpoints)
+	if haproxy.svcPatcher != nil {
+		if haproxy.leader.isLeading() {
+			haproxy.svcPatcher.update(conf.tcpPorts())
+		} else {
+			// the service should be read again if the leadership is acquired
+			haproxy.svcPatcher.ports = nil
+		}
 	}
+	if haproxy.acme != nil {
+		conf.HAAcmePort = haproxy.acmePort
+		// only the replica running HAProxy can answer the challenges,
+		// without active-passive a single replica orders certificates
+		if haproxy.ha != nil {
+			if haproxy.ha.isLeading() {
+				haproxy.acme.check(anns)
+			}
+		} else if haproxy.leader.isLeading() {
+			haproxy.acme.check(anns)
+		}
+	}
+	haproxy.slots.assign(conf.Backends)
 	data, err := haproxy.template.execute(conf)
+	haproxy.metrics.observeSync(time.Since(start), err)
 	if err != nil {
+		haproxy.statsd.count("sync.errors", 1)
+		haproxy.events.renderFailed(err)
 		return nil, err
 	}
+	haproxy.events.renderSucceeded()
+	haproxy.statsd.timing("sync.duration", time.Since(start))
+	haproxy.statsd.gauge("backends", len(conf.Backends))
+	haproxy.statsd.gauge("servers", len(conf.HTTPServers))
+	endpoints := 0
+	for _, backend := range conf.Backends {
+		endpoints += len(backend.HAEndpoints)
+	}
+	haproxy.statsd.gauge("endpoints", endpoints)
+	haproxy.metrics.setObjects("ingresses", len(anns.ingresses))
+	haproxy.metrics.setObjects("backends", len(conf.Backends))
+	haproxy.metrics.setObjects("servers", len(conf.HTTPServers))
+	haproxy.metrics.setObjects("endpoints", endpoints)
 	return data, nil
 }
 
 func (haproxy *haproxyController) Reload(data []byte) ([]byte, bool, error) {
+	if haproxy.dryRun {
+		haproxy.printConfig(data)
+	}
+	if haproxy.ha != nil {
+		return haproxy.ha.reload(haproxy, data)
+	}
+	return haproxy.reload(data)
+}
+
+// reload applies data to HAProxy. configMutex serializes the writes of the
+// configuration files and the updates of configChecksum and configFiles, which
+// are also done by the throttle when a delayed reload is applied.
+func (haproxy *haproxyController) reload(data []byte) ([]byte, bool, error) {
+	haproxy.configMutex.Lock()
+	defer haproxy.configMutex.Unlock()
+	// periodic resyncs usually render the same configuration
+	checksum := configChecksum(data)
+	if checksum == haproxy.configChecksum {
+		return nil, false, nil
+	}
 	if !haproxy.configChanged(data) {
+		haproxy.configChecksum = checksum
 		return nil, false, nil
 	}
-	// TODO missing HAProxy validation before overwrite and try to reload
-	err := ioutil.WriteFile(haproxy.configFile, data, 0644)
-	if err != nil {
+	// a pending reload would overwrite the dynamic update, so the new configuration is reloaded as well
+	pending := haproxy.throttle != nil && haproxy.throttle.isPending()
+	start := time.Now()
+	if current, err := ioutil.ReadFile(haproxy.configFile); err == nil && !pending && dynamicUpdate(haproxy.statsSocket, current, data) {
+		// HAProxy is already up to date, the file is saved to be used on the next reload
+		err := haproxy.writeConfig(data)
+		haproxy.recordApply("dynamic-update", checksum, time.Since(start), err)
 		return nil, false, err
 	}
+	if haproxy.throttle != nil {
+		return haproxy.throttle.run(data, func(data []byte) ([]byte, error) {
+			out, err := haproxy.writeAndReload(data)
+			if err != nil {
+				glog.Errorf("error reloading HAProxy: %v", err)
+			}
+			return out, err
+		})
+	}
+	out, err := haproxy.writeAndReload(data)
+	return out, true, err
+}
+
+// recordApply tracks the outcome of applying a configuration to HAProxy
+func (haproxy *haproxyController) recordApply(method, checksum string, duration time.Duration, err error) {
+	haproxy.applied.record(method, checksum, duration, err)
+	haproxy.metrics.observeApply(method, duration, err)
+}
+
+func (haproxy *haproxyController) writeAndReload(data []byte) ([]byte, error) {
+	// TODO missing HAProxy validation before overwrite and try to reload
+	if err := haproxy.writeConfig(data); err != nil {
+		haproxy.recordApply("reload", configChecksum(data), 0, err)
+		return nil, err
+	}
+	start := time.Now()
 	out, err := haproxy.reloadHaproxy()
 	if len(out) > 0 {
 		glog.Infof("HAProxy output:\n%v", string(out))
 	}
-	return out, true, err
+	haproxy.recordApply("reload", haproxy.configChecksum, time.Since(start), err)
+	haproxy.statsd.timing("reload.duration", time.Since(start))
+	if err != nil {
+		haproxy.statsd.count("reload.errors", 1)
+		haproxy.events.reloadFailed(out, err)
+	} else {
+		haproxy.statsd.count("reload.success", 1)
+		haproxy.events.reloadSucceeded()
+	}
+	return out, err
+}
+
+// printConfig saves the rendered configuration to the dry-run output
+// and exits. Reload is only called after the first complete sync
+// of the cluster state, so data has every ingress already.
+func (haproxy *haproxyController) printConfig(data []byte) {
+	var err error
+	if haproxy.dryRunOutput != "" {
+		err = ioutil.WriteFile(haproxy.dryRunOutput, data, 0644)
+	} else {
+		_, err = os.Stdout.Write(data)
+	}
+	if err != nil {
+		glog.Fatalf("error writing the configuration: %v", err)
+	}
+	os.Exit(0)
+}
+
+// writeConfig saves the whole configuration, used to find changes, and
+// also the split files loaded by HAProxy if split-config is used. configMutex
+// should be held by the caller.
+func (haproxy *haproxyController) writeConfig(data []byte) error {
+	if err := ioutil.WriteFile(haproxy.configFile, data, 0644); err != nil {
+		return err
+	}
+	if haproxy.splitConfig {
+		configFiles, err := writeConfigFiles(filepath.Dir(haproxy.configFile), data)
+		if err != nil {
+			return err
+		}
+		haproxy.configFiles = configFiles
+	}
+	haproxy.configChecksum = configChecksum(data)
+	return nil
 }
 
 func (haproxy *haproxyController) configChanged(data []byte) bool {
@@ -139,6 +482,10 @@ func (haproxy *haproxyController) configChanged(data []byte) bool {
 }
 
 func (haproxy *haproxyController) reloadHaproxy() ([]byte, error) {
-	out, err := exec.Command(haproxy.command, haproxy.configFile).CombinedOutput()
+	configFiles := []string{haproxy.configFile}
+	if haproxy.splitConfig {
+		configFiles = haproxy.configFiles
+	}
+	out, err := exec.Command(haproxy.command, configFiles...).CombinedOutput()
 	return out, err
 }
@@ -0,0 +1,254 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backendCollector exports per backend response time metrics read from the
+// HAProxy stats on every scrape. HAProxy calculates the averages using the
+// last 1024 requests of every backend. The maximum times are only exported
+// if the running HAProxy version has them on its stats.
+type backendCollector struct {
+	socket       string
+	timeDesc     *prometheus.Desc
+	maxTimeDesc  *prometheus.Desc
+	statTimes    map[string]string
+	statMaxTimes map[string]string
+}
+
+func newBackendCollector(socket string) *backendCollector {
+	return &backendCollector{
+		socket: socket,
+		timeDesc: prometheus.NewDesc(
+			"haproxy_ingress_backend_time_average_seconds",
+			"Average time of the last 1024 requests of a backend, split by phase",
+			[]string{"backend", "phase"},
+			nil,
+		),
+		maxTimeDesc: prometheus.NewDesc(
+			"haproxy_ingress_backend_time_max_seconds",
+			"Maximum time of the requests of a backend, split by phase",
+			[]string{"backend", "phase"},
+			nil,
+		),
+		statTimes: map[string]string{
+			"qtime": "queue",
+			"ctime": "connect",
+			"rtime": "response",
+			"ttime": "total",
+		},
+		statMaxTimes: map[string]string{
+			"rtime_max": "response",
+			"ttime_max": "total",
+		},
+	}
+}
+
+func (c *backendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.timeDesc
+	ch <- c.maxTimeDesc
+}
+
+func (c *backendCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := readStats(c.socket)
+	if err != nil {
+		glog.Warningf("error reading HAProxy stats: %v", err)
+		return
+	}
+	for _, stat := range stats {
+		if stat["svname"] != "BACKEND" {
+			continue
+		}
+		c.collectTimes(ch, stat, c.timeDesc, c.statTimes)
+		c.collectTimes(ch, stat, c.maxTimeDesc, c.statMaxTimes)
+	}
+}
+
+// collectTimes exports the stat fields of times, in milliseconds, as seconds.
+// Missing fields are skipped.
+func (c *backendCollector) collectTimes(ch chan<- prometheus.Metric, stat map[string]string, desc *prometheus.Desc, times map[string]string) {
+	for field, phase := range times {
+		ms, err := strconv.ParseFloat(stat[field], 64)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, ms/1000, stat["pxname"], phase)
+	}
+}
+
+// readStats parses `show stat` output, one map of field name to value per proxy or server
+func readStats(socket string) ([]map[string]string, error) {
+	out, err := socketCommand(socket, "show stat")
+	if err != nil {
+		return nil, err
+	}
+	records, err := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(out, []byte("# ")))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	header := records[0]
+	stats := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		stat := make(map[string]string, len(header))
+		for i, value := range record {
+			if i < len(header) {
+				stat[strings.TrimSpace(header[i])] = value
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// cacheCollector exports the number of secrets and configmaps cached by the
+// ingress core, and how many of them are referenced by ingress resources.
+// The ingress core watches all of them, so the difference is memory used
+// by objects the controller doesn't need.
+type cacheCollector struct {
+	haproxy        *haproxyController
+	objectsDesc    *prometheus.Desc
+	referencedDesc *prometheus.Desc
+}
+
+func newCacheCollector(haproxy *haproxyController) *cacheCollector {
+	return &cacheCollector{
+		haproxy: haproxy,
+		objectsDesc: prometheus.NewDesc(
+			"haproxy_ingress_cache_objects",
+			"Number of objects cached by the controller",
+			[]string{"kind"},
+			nil,
+		),
+		referencedDesc: prometheus.NewDesc(
+			"haproxy_ingress_cache_referenced_objects",
+			"Number of cached objects referenced by ingress resources",
+			[]string{"kind"},
+			nil,
+		),
+	}
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.objectsDesc
+	ch <- c.referencedDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	lister := c.haproxy.storeLister
+	if lister == nil {
+		return
+	}
+	secrets, configMaps := referencedObjects(lister)
+	ch <- prometheus.MustNewConstMetric(c.objectsDesc, prometheus.GaugeValue, float64(len(lister.Secret.ListKeys())), "secret")
+	ch <- prometheus.MustNewConstMetric(c.objectsDesc, prometheus.GaugeValue, float64(len(lister.ConfigMap.ListKeys())), "configmap")
+	ch <- prometheus.MustNewConstMetric(c.referencedDesc, prometheus.GaugeValue, float64(len(secrets)), "secret")
+	ch <- prometheus.MustNewConstMetric(c.referencedDesc, prometheus.GaugeValue, float64(len(configMaps)), "configmap")
+}
+
+// controllerMetrics exports the work done by the controller: building the
+// configuration on every sync, and applying it to HAProxy either reloading
+// it or through the admin socket. Reloads are also counted by the ingress core.
+type controllerMetrics struct {
+	syncDuration     prometheus.Histogram
+	syncErrors       prometheus.Counter
+	lastSyncSuccess  prometheus.Gauge
+	objects          *prometheus.GaugeVec
+	applyDuration    *prometheus.HistogramVec
+	applyTotal       *prometheus.CounterVec
+	lastApplySuccess prometheus.Gauge
+	lastApplyTime    prometheus.Gauge
+}
+
+func newControllerMetrics() *controllerMetrics {
+	return &controllerMetrics{
+		syncDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "haproxy_ingress_sync_duration_seconds",
+			Help: "Time spent building the HAProxy configuration",
+		}),
+		syncErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "haproxy_ingress_sync_errors_total",
+			Help: "Number of syncs which failed to build the HAProxy configuration",
+		}),
+		lastSyncSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "haproxy_ingress_last_sync_success",
+			Help: "Whether the last sync built the HAProxy configuration, 1, or failed, 0",
+		}),
+		objects: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "haproxy_ingress_objects",
+			Help: "Number of ingress resources, backends, hostnames and endpoints of the last configuration",
+		}, []string{"kind"}),
+		applyDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "haproxy_ingress_apply_duration_seconds",
+			Help: "Time spent applying a configuration to HAProxy",
+		}, []string{"method"}),
+		applyTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "haproxy_ingress_apply_total",
+			Help: "Number of configurations applied to HAProxy",
+		}, []string{"method", "result"}),
+		lastApplySuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "haproxy_ingress_last_apply_success",
+			Help: "Whether the last configuration was applied to HAProxy, 1, or failed, 0",
+		}),
+		lastApplyTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "haproxy_ingress_last_apply_timestamp_seconds",
+			Help: "Time of the last attempt to apply a configuration to HAProxy",
+		}),
+	}
+}
+
+func (m *controllerMetrics) register() {
+	prometheus.MustRegister(m.syncDuration, m.syncErrors, m.lastSyncSuccess, m.objects,
+		m.applyDuration, m.applyTotal, m.lastApplySuccess, m.lastApplyTime)
+}
+
+func (m *controllerMetrics) observeSync(duration time.Duration, err error) {
+	if err != nil {
+		m.syncErrors.Inc()
+		m.lastSyncSuccess.Set(0)
+		return
+	}
+	m.syncDuration.Observe(duration.Seconds())
+	m.lastSyncSuccess.Set(1)
+}
+
+func (m *controllerMetrics) setObjects(kind string, count int) {
+	m.objects.WithLabelValues(kind).Set(float64(count))
+}
+
+func (m *controllerMetrics) observeApply(method string, duration time.Duration, err error) {
+	result := "success"
+	success := 1.0
+	if err != nil {
+		result = "error"
+		success = 0
+	}
+	m.applyTotal.WithLabelValues(method, result).Inc()
+	m.applyDuration.WithLabelValues(method).Observe(duration.Seconds())
+	m.lastApplySuccess.Set(success)
+	m.lastApplyTime.Set(float64(time.Now().Unix()))
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress"
+	"k8s.io/ingress/core/pkg/ingress/defaults"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	client "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	"time"
+)
+
+// namespaceFilter restricts the ingress resources used to build the configuration
+// to a list of namespaces and the namespaces matching a label selector. Namespaces
+// aren't watched by the ingress core, so changes on their labels are applied on
+// the next sync.
+type namespaceFilter struct {
+	names      map[string]bool
+	selector   labels.Selector
+	store      cache.Store
+	controller *cache.Controller
+}
+
+func newNamespaceFilter(kubeClient *client.Clientset, list, selector string, resyncPeriod time.Duration) (*namespaceFilter, error) {
+	filter := &namespaceFilter{
+		names: map[string]bool{},
+	}
+	for _, name := range splitList(list) {
+		filter.names[name] = true
+	}
+	if selector != "" {
+		sel, err := labels.Parse(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace selector '%v': %v", selector, err)
+		}
+		filter.selector = sel
+		filter.store, filter.controller = cache.NewInformer(
+			cache.NewListWatchFromClient(kubeClient.Core().RESTClient(), "namespaces", api.NamespaceAll, fields.Everything()),
+			&api.Namespace{},
+			resyncPeriod,
+			cache.ResourceEventHandlerFuncs{})
+	}
+	return filter, nil
+}
+
+func (f *namespaceFilter) run() {
+	if f.controller != nil {
+		f.controller.Run(make(chan struct{}))
+	}
+}
+
+// allowed returns true if the ingress resources of a namespace should be used,
+// a nil filter allows every namespace
+func (f *namespaceFilter) allowed(namespace string) bool {
+	if f == nil || f.names[namespace] {
+		return true
+	}
+	if f.selector == nil {
+		return false
+	}
+	obj, exists, err := f.store.GetByKey(namespace)
+	if err != nil || !exists {
+		return false
+	}
+	return f.selector.Matches(labels.Set(obj.(*api.Namespace).Labels))
+}
+
+// applyNamespaceFilter removes from the configuration built by the ingress core
+// the hostnames, locations and backends which were only declared by ingress
+// resources of namespaces which aren't watched. anns should be built with the
+// same filter. Locations declared on more than one namespace are assigned to
+// the oldest ingress of a watched namespace.
+func applyNamespaceFilter(cfg *ingress.Configuration, anns *ingressAnnotations, def defaults.Backend) {
+	hosts := map[string]bool{}
+	tlsHosts := map[string]bool{}
+	for _, ing := range anns.ingresses {
+		if ing.Spec.Backend != nil {
+			hosts["_"] = true
+		}
+		for _, rule := range ing.Spec.Rules {
+			host := rule.Host
+			if host == "" {
+				host = "_"
+			}
+			hosts[host] = true
+		}
+		for _, tls := range ing.Spec.TLS {
+			for _, host := range tls.Hosts {
+				tlsHosts[host] = true
+			}
+		}
+	}
+	coreBackends := make(map[string]bool, len(cfg.Backends))
+	for _, backend := range cfg.Backends {
+		coreBackends[backend.Name] = true
+	}
+	resolver := &conflictResolver{anns: anns, defaults: def}
+	servers := make([]*ingress.Server, 0, len(cfg.Servers))
+	for _, server := range cfg.Servers {
+		if server.Hostname != "_" && !hosts[server.Hostname] {
+			glog.V(2).Infof("ignoring hostname %v, declared on namespaces which aren't watched", server.Hostname)
+			continue
+		}
+		if server.Hostname != "_" && !tlsHosts[server.Hostname] {
+			server.SSLCertificate = ""
+			server.SSLPemChecksum = ""
+		}
+		locations := make([]*ingress.Location, 0, len(server.Locations))
+		for _, location := range server.Locations {
+			claims := anns.locationClaims(server.Hostname, location.Path)
+			if len(claims) == 0 {
+				if location.Path != "/" {
+					continue
+				}
+				// root location created by the ingress core with the default
+				// backend of the ingress which declared the hostname
+				if _, found := anns.backends[location.Backend]; !found {
+					location.Backend = defaultBackendName
+				}
+				location.IsDefBackend = true
+				locations = append(locations, location)
+				continue
+			}
+			oldest := claims[0]
+			backendName := fmt.Sprintf("%v-%v-%v", oldest.ingress.Namespace, oldest.backend.ServiceName, oldest.backend.ServicePort.String())
+			if !coreBackends[backendName] {
+				glog.Warningf("backend %v of ingress %v/%v was not found", backendName, oldest.ingress.Namespace, oldest.ingress.Name)
+				backendName = defaultBackendName
+			}
+			if location.Backend != backendName {
+				location.Backend = backendName
+				location.IsDefBackend = false
+				updateLocation(location, oldest.ingress, resolver)
+			}
+			locations = append(locations, location)
+		}
+		server.Locations = locations
+		servers = append(servers, server)
+	}
+	cfg.Servers = servers
+	backendNames := map[string]bool{defaultBackendName: true}
+	for _, server := range cfg.Servers {
+		for _, location := range server.Locations {
+			backendNames[location.Backend] = true
+		}
+	}
+	backends := make([]*ingress.Backend, 0, len(cfg.Backends))
+	for _, backend := range cfg.Backends {
+		if _, found := anns.backends[backend.Name]; found || backendNames[backend.Name] {
+			backends = append(backends, backend)
+		}
+	}
+	cfg.Backends = backends
+	passthroughBackends := make([]*ingress.SSLPassthroughBackend, 0, len(cfg.PassthroughBackends))
+	for _, passthrough := range cfg.PassthroughBackends {
+		if hosts[passthrough.Hostname] && backendNames[passthrough.Backend] {
+			passthroughBackends = append(passthroughBackends, passthrough)
+		}
+	}
+	cfg.PassthroughBackends = passthroughBackends
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress"
+	"regexp"
+	"strings"
+)
+
+var oauthURIPrefixRegex = regexp.MustCompile(`^/[A-Za-z0-9/_.-]*$`)
+
+// newHAProxyOAuth reads the oauth annotations of a location. The oauth2_proxy
+// service is the backend of the oauth-uri-prefix path of the same hostname.
+func newHAProxyOAuth(server *ingress.Server, location *haproxyLocation) *haproxyAuthRequest {
+	if location.OAuth != "oauth2_proxy" {
+		glog.Warningf("ignoring unsupported oauth implementation of %v%v, should be oauth2_proxy: %v", server.Hostname, location.Path, location.OAuth)
+		return nil
+	}
+	prefix := strings.TrimSuffix(location.OAuthURIPrefix, "/")
+	if !oauthURIPrefixRegex.MatchString(prefix) {
+		glog.Warningf("ignoring invalid oauth uri prefix of %v%v: %v", server.Hostname, location.Path, location.OAuthURIPrefix)
+		return nil
+	}
+	if strings.HasPrefix(location.Path, prefix) {
+		// the oauth2_proxy paths cannot be authenticated
+		return nil
+	}
+	oauth := &haproxyAuthRequest{
+		Path:    prefix + "/auth",
+		SignIn:  prefix + "/start?rd=%[path]",
+		Headers: authHeaders(server.Hostname, location.Path, location.OAuthHeaders),
+	}
+	for _, loc := range server.Locations {
+		if loc.Path == prefix || loc.Path == prefix+"/" {
+			oauth.Backend = loc.Backend
+		}
+	}
+	if oauth.Backend == "" {
+		glog.Warningf("ignoring oauth of %v%v, path %v should be declared on the same hostname", server.Hostname, location.Path, prefix)
+		return nil
+	}
+	return oauth
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress"
+	"sort"
+)
+
+// haproxySSLPassthrough routes the TLS connections of a hostname, without
+// decrypting them, from the https frontend or a named frontend to Backend
+type haproxySSLPassthrough struct {
+	Hostname string
+	Backend  string
+	Frontend string
+}
+
+// newSSLPassthrough builds the routes of the hostnames whose ingress uses the
+// ssl-passthrough annotation, and adds the tcp mode backends used by them to
+// tcpBackends. The other hostnames of the same frontends still terminate TLS.
+func newSSLPassthrough(cfg *ingress.Configuration, anns *ingressAnnotations, frontends []*haproxyFrontend, servers []*haproxyServer, tcpBackends []*haproxyTCPBackend) ([]*haproxySSLPassthrough, []*haproxyTCPBackend) {
+	backends := map[string]*haproxyTCPBackend{}
+	for _, backend := range tcpBackends {
+		backends[backend.Name] = backend
+	}
+	frontendNames := map[string]*haproxyFrontend{}
+	for _, frontend := range frontends {
+		frontendNames[frontend.Name] = frontend
+	}
+	routes := []*haproxySSLPassthrough{}
+	for _, passthrough := range cfg.PassthroughBackends {
+		if passthrough.Hostname == "_" {
+			glog.Warningf("ignoring ssl-passthrough of the default server, TLS connections are routed by the hostname")
+			continue
+		}
+		var backend *ingress.Backend
+		for _, b := range cfg.Backends {
+			if b.Name == passthrough.Backend {
+				backend = b
+				break
+			}
+		}
+		if backend == nil {
+			glog.Warningf("ignoring ssl-passthrough of %v, backend %v was not found", passthrough.Hostname, passthrough.Backend)
+			continue
+		}
+		frontend := ""
+		for _, server := range servers {
+			if server.Hostname == passthrough.Hostname {
+				if fe := serverFrontend(anns, frontendNames, server); fe != nil {
+					frontend = fe.Name
+				}
+				break
+			}
+		}
+		// same name of the tcp sni backends, both are tcp mode backends
+		// with the endpoints of the same service and port
+		backendName := "tcp_" + backend.Name
+		if _, found := backends[backendName]; !found {
+			endpoints := make([]ingress.Endpoint, 0, len(backend.Endpoints))
+			for _, endpoint := range backend.Endpoints {
+				if endpoint != emptyBackendEndpoint {
+					endpoints = append(endpoints, endpoint)
+				}
+			}
+			backends[backendName] = &haproxyTCPBackend{
+				Name:      backendName,
+				Service:   backend.Name,
+				Endpoints: endpoints,
+			}
+		}
+		routes = append(routes, &haproxySSLPassthrough{
+			Hostname: passthrough.Hostname,
+			Backend:  backendName,
+			Frontend: frontend,
+		})
+	}
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	backendList := make([]*haproxyTCPBackend, len(names))
+	for i, name := range names {
+		backendList[i] = backends[name]
+	}
+	return routes, backendList
+}
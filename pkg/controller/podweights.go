@@ -0,0 +1,94 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	client "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	"k8s.io/kubernetes/pkg/fields"
+	"strconv"
+	"time"
+)
+
+const (
+	podWeightAnnotation = annotationPrefix + "weight"
+	podIPIndex          = "podIP"
+	// podMaxWeight is the maximum weight of a server on HAProxy
+	podMaxWeight = 256
+)
+
+// podWeights watches the pods of the cluster and reads the weight of their
+// endpoints from the weight annotation. Pods aren't watched by the ingress
+// core, so changes on the annotation are applied on the next sync.
+type podWeights struct {
+	indexer    cache.Indexer
+	controller *cache.Controller
+}
+
+func newPodWeights(kubeClient *client.Clientset, namespace string, resyncPeriod time.Duration) *podWeights {
+	weights := &podWeights{}
+	weights.indexer, weights.controller = cache.NewIndexerInformer(
+		cache.NewListWatchFromClient(kubeClient.Core().RESTClient(), "pods", namespace, fields.Everything()),
+		&api.Pod{},
+		resyncPeriod,
+		cache.ResourceEventHandlerFuncs{},
+		cache.Indexers{podIPIndex: podIPIndexFunc})
+	return weights
+}
+
+func podIPIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*api.Pod)
+	if !ok || pod.Status.PodIP == "" {
+		return []string{}, nil
+	}
+	return []string{pod.Status.PodIP}, nil
+}
+
+func (w *podWeights) run() {
+	w.controller.Run(make(chan struct{}))
+}
+
+// weight returns the weight of the running pod with the IP address of an
+// endpoint, or -1 if the pod isn't found or doesn't declare a valid weight
+func (w *podWeights) weight(ip string) int {
+	if w == nil {
+		return -1
+	}
+	pods, err := w.indexer.ByIndex(podIPIndex, ip)
+	if err != nil {
+		return -1
+	}
+	for _, obj := range pods {
+		pod := obj.(*api.Pod)
+		if pod.Status.Phase != api.PodRunning {
+			continue
+		}
+		value, found := pod.Annotations[podWeightAnnotation]
+		if !found {
+			return -1
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 || weight > podMaxWeight {
+			glog.Warningf("ignoring invalid weight of pod %v/%v: %v", pod.Namespace, pod.Name, value)
+			return -1
+		}
+		return weight
+	}
+	return -1
+}
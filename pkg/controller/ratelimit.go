@@ -0,0 +1,100 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/golang/glog"
+	"regexp"
+	"sort"
+)
+
+// haproxyRateLimit limits the request rate of a location per client, the client
+// is identified by Key. Requests are tracked on a stick table of the location.
+type haproxyRateLimit struct {
+	Table     string
+	TableType string
+	Key       string
+	Period    string
+	Expire    string
+	Limit     int
+}
+
+var rateLimitHeaderRegex = regexp.MustCompile(`^hdr\(([A-Za-z0-9_-]+)\)$`)
+
+// newHAProxyRateLimit reads the rate-limit-rps or rate-limit-rpm annotations of a location,
+// rps has precedence. Burst is added to the limit of the period.
+func newHAProxyRateLimit(hostname string, location *haproxyLocation) *haproxyRateLimit {
+	rateLimit := &haproxyRateLimit{}
+	switch {
+	case location.RateLimitRPS > 0:
+		rateLimit.Period = "1s"
+		rateLimit.Expire = "10s"
+		rateLimit.Limit = location.RateLimitRPS
+	case location.RateLimitRPM > 0:
+		rateLimit.Period = "1m"
+		rateLimit.Expire = "2m"
+		rateLimit.Limit = location.RateLimitRPM
+	default:
+		return nil
+	}
+	if location.RateLimitBurst > 0 {
+		rateLimit.Limit += location.RateLimitBurst
+	}
+	switch key := location.RateLimitKey; {
+	case key == "" || key == "src":
+		rateLimit.Key = "src"
+		rateLimit.TableType = "ipv6"
+	case rateLimitHeaderRegex.MatchString(key):
+		rateLimit.Key = "req.hdr(" + rateLimitHeaderRegex.FindStringSubmatch(key)[1] + ")"
+		rateLimit.TableType = "string len 64"
+	default:
+		glog.Warningf("invalid rate limit key of %v%v, should be src or hdr(<name>): %v", hostname, location.Path, key)
+		return nil
+	}
+	rateLimit.Table = fmt.Sprintf("ratelimit-%x", sha1.Sum([]byte(hostname+location.Path)))[:20]
+	return rateLimit
+}
+
+// rateLimitTables lists the rate limits of all the locations, without duplicates,
+// each one needs its own stick table
+func rateLimitTables(serverLists ...[]*haproxyServer) []*haproxyRateLimit {
+	tables := map[string]*haproxyRateLimit{}
+	for _, servers := range serverLists {
+		for _, server := range servers {
+			if server == nil {
+				continue
+			}
+			for _, location := range server.Locations {
+				if location.HARateLimit != nil {
+					tables[location.HARateLimit.Table] = location.HARateLimit
+				}
+			}
+		}
+	}
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rateLimits := make([]*haproxyRateLimit, len(names))
+	for i, name := range names {
+		rateLimits[i] = tables[name]
+	}
+	return rateLimits
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"github.com/golang/glog"
+	"net"
+	"os"
+	"strings"
+)
+
+// resolvConf is read to find the nameservers used by HAProxy
+// to resolve the DNS names of ExternalName services
+var resolvConf = "/etc/resolv.conf"
+
+// nameservers lists the nameservers of resolvConf as ip:port. HAProxy and the
+// controller run in the same pod, so they use the same cluster DNS.
+func nameservers() []string {
+	file, err := os.Open(resolvConf)
+	if err != nil {
+		glog.Warningf("error reading nameservers: %v", err)
+		return nil
+	}
+	defer file.Close()
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if net.ParseIP(fields[1]) == nil {
+			glog.Warningf("ignoring invalid nameserver of %v: %v", resolvConf, fields[1])
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(fields[1], "53"))
+	}
+	return servers
+}
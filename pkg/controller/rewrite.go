@@ -0,0 +1,103 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"regexp"
+	"strings"
+)
+
+// haproxyRewrite changes the path of the requests of a location before
+// sending them to the backend. Match is built against txn.path, the
+// original path, so a rewritten path isn't matched by other locations.
+type haproxyRewrite struct {
+	Hostname    string
+	Match       string
+	Pattern     string
+	Replacement string
+}
+
+// rewritePathRegex restricts paths and targets to characters
+// which don't need to be escaped on a regsub converter
+var rewritePathRegex = regexp.MustCompile(`^/[A-Za-z0-9/_.~-]*$`)
+
+// assignRewrites adds to the backends the rewrite rules of the locations
+// which use the rewrite-target annotation. Rules are created in the backend
+// because the frontends choose the backend using the original path.
+func assignRewrites(backends []*haproxyBackend, serverLists ...[]*haproxyServer) {
+	backendNames := map[string]*haproxyBackend{}
+	for _, backend := range backends {
+		backendNames[backend.Name] = backend
+	}
+	added := map[*haproxyServer]bool{}
+	for _, servers := range serverLists {
+		for _, server := range servers {
+			if server == nil || added[server] {
+				continue
+			}
+			added[server] = true
+			for i, location := range server.Locations {
+				target := location.Redirect.Target
+				if target == "" || (location.IsRootLocation && target == "/") {
+					continue
+				}
+				backend, found := backendNames[location.Backend]
+				if !found {
+					continue
+				}
+				if !rewritePathRegex.MatchString(target) || !rewritePathRegex.MatchString(location.Path) {
+					glog.Warningf("ignoring rewrite of %v%v to %v, unsupported characters", server.Hostname, location.Path, target)
+					continue
+				}
+				backend.HARewrites = append(backend.HARewrites, newHAProxyRewrite(server, server.Locations[:i], location))
+			}
+		}
+	}
+}
+
+// newHAProxyRewrite builds the rewrite of a location. moreSpecific are the
+// locations of the same server sorted before location, see locationBySpecificity.
+func newHAProxyRewrite(server *haproxyServer, moreSpecific []*haproxyLocation, location *haproxyLocation) *haproxyRewrite {
+	rewrite := &haproxyRewrite{}
+	if !server.IsDefaultServer {
+		rewrite.Hostname = server.Hostname
+	}
+	if !location.IsRootLocation {
+		rewrite.Match = " { var(txn.path) -m beg " + location.Path + " }"
+	}
+	exclude := ""
+	for _, other := range moreSpecific {
+		if other.Path != location.Path && strings.HasPrefix(other.Path, location.Path) {
+			exclude = exclude + " " + other.Path
+		}
+	}
+	if exclude != "" {
+		rewrite.Match = rewrite.Match + " !{ var(txn.path) -m beg" + exclude + " }"
+	}
+	// `/app/sub` to `/` or `/api/` should be `/sub` or `/api/sub`,
+	// and to `/api` should be `/api/sub` as well
+	path := strings.TrimSuffix(location.Path, "/")
+	target := location.Redirect.Target
+	if strings.HasSuffix(target, "/") {
+		rewrite.Pattern = "^" + path + "/?"
+	} else {
+		rewrite.Pattern = "^" + path
+	}
+	rewrite.Replacement = target
+	return rewrite
+}
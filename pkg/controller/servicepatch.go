@@ -0,0 +1,115 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	client "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	"k8s.io/kubernetes/pkg/util/intstr"
+	"strings"
+)
+
+// tcpPortPrefix names the ports of the controller Service which are owned
+// by the service patcher. Ports with other names are left untouched.
+const tcpPortPrefix = "tcp-"
+
+// servicePatcher keeps the ports of the controller Service in sync with
+// the TCP ports exposed by HAProxy, from the TCP services ConfigMap and
+// the tcp-sni-services option
+type servicePatcher struct {
+	client    *client.Clientset
+	namespace string
+	name      string
+	ports     map[int]bool
+}
+
+func newServicePatcher(kubeClient *client.Clientset, service string) (*servicePatcher, error) {
+	svc := strings.Split(service, "/")
+	if len(svc) != 2 {
+		return nil, fmt.Errorf("invalid service format (namespace/name): %v", service)
+	}
+	return &servicePatcher{
+		client:    kubeClient,
+		namespace: svc[0],
+		name:      svc[1],
+	}, nil
+}
+
+// update adds the missing TCP ports to the controller Service and removes
+// the ones which aren't exposed anymore. The Service is only read and
+// updated if the list of ports changed since the last successful update.
+func (p *servicePatcher) update(tcpPorts []int) {
+	ports := map[int]bool{}
+	for _, port := range tcpPorts {
+		ports[port] = true
+	}
+	if p.ports != nil && samePorts(p.ports, ports) {
+		return
+	}
+	svcAPI := p.client.Core().Services(p.namespace)
+	svc, err := svcAPI.Get(p.name)
+	if err != nil {
+		glog.Warningf("error reading service %v/%v: %v", p.namespace, p.name, err)
+		return
+	}
+	svcPorts := []api.ServicePort{}
+	for _, port := range svc.Spec.Ports {
+		if !strings.HasPrefix(port.Name, tcpPortPrefix) || ports[int(port.Port)] {
+			svcPorts = append(svcPorts, port)
+		}
+	}
+	for port := range ports {
+		if !hasServicePort(svcPorts, port) {
+			svcPorts = append(svcPorts, api.ServicePort{
+				Name:       fmt.Sprintf("%v%v", tcpPortPrefix, port),
+				Protocol:   api.ProtocolTCP,
+				Port:       int32(port),
+				TargetPort: intstr.FromInt(port),
+			})
+		}
+	}
+	svc.Spec.Ports = svcPorts
+	if _, err := svcAPI.Update(svc); err != nil {
+		glog.Warningf("error updating ports of service %v/%v: %v", p.namespace, p.name, err)
+		return
+	}
+	glog.Infof("ports of service %v/%v updated", p.namespace, p.name)
+	p.ports = ports
+}
+
+func samePorts(p1, p2 map[int]bool) bool {
+	if len(p1) != len(p2) {
+		return false
+	}
+	for port := range p1 {
+		if !p2[port] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasServicePort(ports []api.ServicePort, port int) bool {
+	for _, svcPort := range ports {
+		if int(svcPort.Port) == port {
+			return true
+		}
+	}
+	return false
+}
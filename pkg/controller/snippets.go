@@ -0,0 +1,55 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sectionKeywords start a new section of the HAProxy configuration,
+// a snippet using them would move the following lines to another section
+var sectionKeywords = map[string]bool{
+	"global":    true,
+	"defaults":  true,
+	"frontend":  true,
+	"backend":   true,
+	"listen":    true,
+	"userlist":  true,
+	"peers":     true,
+	"resolvers": true,
+	"mailers":   true,
+	"cache":     true,
+	"program":   true,
+}
+
+// configSnippet splits a snippet of raw HAProxy configuration into trimmed
+// lines, empty lines are removed. Snippets declaring a section are rejected.
+func configSnippet(snippet string) ([]string, error) {
+	var lines []string
+	for _, line := range strings.Split(snippet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if keyword := strings.Fields(line)[0]; sectionKeywords[keyword] {
+			return nil, fmt.Errorf("section keyword is not allowed: %v", keyword)
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
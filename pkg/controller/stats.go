@@ -0,0 +1,41 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+)
+
+// statsUserlistName doesn't use a dash, so it doesn't conflict
+// with the userlists of the auth-secret annotation
+const statsUserlistName = "stats_auth"
+
+// statsUserlist reads the users of the stats page from the auth key of a secret,
+// which uses the htpasswd format of the secrets of the auth-secret annotation
+func statsUserlist(anns *ingressAnnotations, secretName string) (*userlist, error) {
+	users, err := secretUsers(anns, secretName, statsUserlistName)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("secret %v doesn't have valid users", secretName)
+	}
+	return &userlist{
+		ListName: statsUserlistName,
+		Users:    users,
+	}, nil
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"net"
+	"time"
+)
+
+// statsdClient sends controller metrics to a StatsD or DogStatsD server.
+// Methods of a nil client do nothing, so callers don't need to check
+// if StatsD is configured.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+}
+
+func newStatsdClient(address, prefix string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix = prefix + "."
+	}
+	return &statsdClient{
+		conn:   conn,
+		prefix: prefix,
+	}, nil
+}
+
+func (c *statsdClient) timing(name string, d time.Duration) {
+	c.send(name, fmt.Sprintf("%d|ms", d.Nanoseconds()/int64(time.Millisecond)))
+}
+
+func (c *statsdClient) count(name string, value int) {
+	c.send(name, fmt.Sprintf("%d|c", value))
+}
+
+func (c *statsdClient) gauge(name string, value int) {
+	c.send(name, fmt.Sprintf("%d|g", value))
+}
+
+func (c *statsdClient) send(name, value string) {
+	if c == nil {
+		return
+	}
+	// UDP, errors only mean the server isn't listening
+	if _, err := fmt.Fprintf(c.conn, "%v%v:%v", c.prefix, name, value); err != nil {
+		glog.V(2).Infof("error sending %v to statsd: %v", name, err)
+	}
+}
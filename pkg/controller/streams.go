@@ -0,0 +1,185 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/intstr"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tcpService describes a port exposed by HAProxy from the TCP services ConfigMap
+type tcpService struct {
+	Port      int      `json:"port"`
+	Service   string   `json:"service"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// streamTracker keeps the TCP services currently exposed, so they can be
+// read from the API. Changes on the exposed ports are also logged, and
+// reported as events on the controller pod if events is assigned.
+type streamTracker struct {
+	mutex    sync.RWMutex
+	services []tcpService
+	events   *eventReporter
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{
+		services: []tcpService{},
+	}
+}
+
+func (t *streamTracker) update(tcpEndpoints, udpEndpoints []ingress.L4Service) {
+	services := make([]tcpService, len(tcpEndpoints))
+	for i, tcp := range tcpEndpoints {
+		endpoints := make([]string, len(tcp.Endpoints))
+		for j, ep := range tcp.Endpoints {
+			endpoints[j] = fmt.Sprintf("%v:%v", ep.Address, ep.Port)
+		}
+		services[i] = tcpService{
+			Port:      tcp.Port,
+			Service:   fmt.Sprintf("%v/%v:%v", tcp.Backend.Namespace, tcp.Backend.Name, tcp.Backend.Port.String()),
+			Endpoints: endpoints,
+		}
+	}
+	for _, udp := range udpEndpoints {
+		glog.Warningf("UDP service %v/%v on port %v is not supported by HAProxy, ignoring", udp.Backend.Namespace, udp.Backend.Name, udp.Port)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	current := map[int]string{}
+	for _, svc := range t.services {
+		current[svc.Port] = svc.Service
+	}
+	for _, svc := range services {
+		if service, found := current[svc.Port]; !found || service != svc.Service {
+			glog.Infof("exposing TCP port %v to service %v", svc.Port, svc.Service)
+			t.events.tcpPortExposed(svc.Port, svc.Service)
+		}
+		delete(current, svc.Port)
+	}
+	for port, service := range current {
+		glog.Infof("removing TCP port %v of service %v", port, service)
+		t.events.tcpPortRemoved(port, service)
+	}
+	t.services = services
+}
+
+func (t *streamTracker) list() []tcpService {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.services
+}
+
+// tcpServiceOptions are the options of the extended syntax of the TCP services
+// ConfigMap, separated by colons after the service port, e.g.
+// `<namespace>/<service>:5432:ssl=db-tls:accept-proxy:send-proxy-v2`
+type tcpServiceOptions struct {
+	SSLCertificate string
+	SSLPemChecksum string
+	AcceptProxy    bool
+	SendProxy      string
+}
+
+// newExtendedTCPServices reads the TCP services which use options. The ingress
+// core only reads the services without options and ignores the other ones.
+// Services whose options can't be applied aren't exposed, so a TLS port isn't
+// exposed without TLS.
+func newExtendedTCPServices(anns *ingressAnnotations, configMapName string) ([]ingress.L4Service, map[int]*tcpServiceOptions) {
+	services := []ingress.L4Service{}
+	options := map[int]*tcpServiceOptions{}
+	if configMapName == "" || anns.lister == nil {
+		return services, options
+	}
+	obj, exists, err := anns.lister.ConfigMap.GetByKey(configMapName)
+	if err != nil || !exists {
+		return services, options
+	}
+	data := obj.(*api.ConfigMap).Data
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields := strings.Split(data[key], ":")
+		if len(fields) <= 2 {
+			continue
+		}
+		port, err := strconv.Atoi(key)
+		if err != nil || port <= 0 || port > 65535 || port == 80 || port == 443 {
+			glog.Warningf("invalid port of TCP service: %v", key)
+			continue
+		}
+		svc := strings.Split(fields[0], "/")
+		if len(svc) != 2 || svc[0] == "" || svc[1] == "" || fields[1] == "" {
+			glog.Warningf("invalid format of TCP service %v (namespace/name:port[:option...]): %v", key, data[key])
+			continue
+		}
+		opts := &tcpServiceOptions{}
+		valid := true
+		for _, opt := range fields[2:] {
+			switch {
+			case opt == "accept-proxy":
+				opts.AcceptProxy = true
+			case opt == "send-proxy" || opt == "send-proxy-v2":
+				opts.SendProxy = opt
+			case strings.HasPrefix(opt, "ssl="):
+				secretName := strings.TrimPrefix(opt, "ssl=")
+				if !strings.Contains(secretName, "/") {
+					secretName = svc[0] + "/" + secretName
+				}
+				pem, err := secretPemFile(anns, "tcp-"+key, secretName)
+				if err != nil {
+					glog.Warningf("ignoring TCP service %v, error reading its certificate: %v", key, err)
+					valid = false
+				} else {
+					opts.SSLCertificate, opts.SSLPemChecksum = pem.PemFileName, pem.PemSHA
+				}
+			default:
+				glog.Warningf("ignoring TCP service %v, invalid option: %v", key, opt)
+				valid = false
+			}
+		}
+		if !valid {
+			continue
+		}
+		svcPort := intstr.FromString(fields[1])
+		if number, err := strconv.Atoi(fields[1]); err == nil {
+			svcPort = intstr.FromInt(number)
+		}
+		services = append(services, ingress.L4Service{
+			Port: port,
+			Backend: ingress.L4Backend{
+				Namespace: svc[0],
+				Name:      svc[1],
+				Port:      svcPort,
+				Protocol:  api.ProtocolTCP,
+			},
+			Endpoints: anns.serviceEndpoints(svc[0], svc[1], fields[1], false),
+		})
+		options[port] = opts
+	}
+	return services, options
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+type (
+	stickTable struct {
+		Name    string       `json:"name"`
+		Type    string       `json:"type"`
+		Size    int64        `json:"size"`
+		Used    int64        `json:"used"`
+		Entries []stickEntry `json:"entries"`
+	}
+	stickEntry struct {
+		Key  string           `json:"key"`
+		Use  int64            `json:"use"`
+		Exp  int64            `json:"exp"`
+		Data map[string]int64 `json:"data"`
+	}
+)
+
+// readStickTables reads all the stick tables and its entries from the admin socket.
+// If name isn't empty, only the table with the given name is read.
+func readStickTables(socket string, name string) ([]*stickTable, error) {
+	out, err := socketCommand(socket, "show table")
+	if err != nil {
+		return nil, err
+	}
+	tables := []*stickTable{}
+	for _, table := range parseStickTables(out) {
+		if name != "" && table.Name != name {
+			continue
+		}
+		out, err := socketCommand(socket, "show table "+table.Name)
+		if err != nil {
+			return nil, err
+		}
+		if dump := parseStickTables(out); len(dump) > 0 {
+			table = dump[0]
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// parseStickTables parses the output of `show table`, e.g.:
+//
+//	# table: conn-rate-source, type: ip, size:204800, used:1
+//	0x55d1c8d4a3f4: key=10.0.0.1 use=0 exp=9580 conn_rate(1000)=1
+func parseStickTables(out []byte) []*stickTable {
+	tables := []*stickTable{}
+	var table *stickTable
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "# table:") {
+			table = &stickTable{Entries: []stickEntry{}}
+			for _, field := range strings.Split(strings.TrimPrefix(line, "#"), ",") {
+				sep := strings.Index(field, ":")
+				if sep < 0 {
+					continue
+				}
+				value := strings.TrimSpace(field[sep+1:])
+				switch strings.TrimSpace(field[:sep]) {
+				case "table":
+					table.Name = value
+				case "type":
+					table.Type = value
+				case "size":
+					table.Size, _ = strconv.ParseInt(value, 10, 64)
+				case "used":
+					table.Used, _ = strconv.ParseInt(value, 10, 64)
+				}
+			}
+			tables = append(tables, table)
+			continue
+		}
+		sep := strings.Index(line, ": ")
+		if table == nil || sep < 0 {
+			continue
+		}
+		entry := stickEntry{Data: map[string]int64{}}
+		for _, field := range strings.Fields(line[sep+2:]) {
+			eq := strings.Index(field, "=")
+			if eq < 0 {
+				continue
+			}
+			key, value := field[:eq], field[eq+1:]
+			switch key {
+			case "key":
+				entry.Key = value
+			case "use":
+				entry.Use, _ = strconv.ParseInt(value, 10, 64)
+			case "exp":
+				entry.Exp, _ = strconv.ParseInt(value, 10, 64)
+			default:
+				if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+					entry.Data[key] = n
+				}
+			}
+		}
+		table.Entries = append(table.Entries, entry)
+	}
+	return tables
+}
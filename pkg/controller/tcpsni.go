@@ -0,0 +1,146 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/ingress/core/pkg/ingress"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// haproxyTCPSNIFrontend is a tcp mode frontend of the tcp-sni-services ConfigMap
+// option, which routes TLS connections by SNI without decrypting them
+type haproxyTCPSNIFrontend struct {
+	Port           int
+	Routes         []*tcpSNIRoute
+	DefaultBackend string
+}
+
+// tcpSNIRoute sends the connections to Hostname to Backend
+type tcpSNIRoute struct {
+	Hostname string
+	Backend  string
+}
+
+// haproxyTCPBackend is a tcp mode backend with the endpoints of a service
+type haproxyTCPBackend struct {
+	Name      string
+	Service   string
+	Endpoints []ingress.Endpoint
+}
+
+var tcpSNIHostnameRegex = regexp.MustCompile(`^([A-Za-z0-9-]+\.)*[A-Za-z0-9-]+$`)
+
+// tcpSNIServiceRegex matches <namespace>/<service>:<port>, the port can be
+// the number or the name of a port of the service
+var tcpSNIServiceRegex = regexp.MustCompile(`^([a-z0-9.-]+)/([a-z0-9.-]+):([A-Za-z0-9-]+)$`)
+
+// newTCPSNIServices parses a comma-separated list of <port>/<hostname>=<namespace>/<service>:<port>.
+// The hostname `*` is the default route of the port. Ports exposed by the TCP services
+// ConfigMap, or used by HAProxy, are ignored.
+func newTCPSNIServices(anns *ingressAnnotations, list string, usedPorts map[int]bool) ([]*haproxyTCPSNIFrontend, []*haproxyTCPBackend) {
+	frontends := map[int]*haproxyTCPSNIFrontend{}
+	backends := map[string]*haproxyTCPBackend{}
+	for _, item := range splitList(list) {
+		route := strings.Split(item, "=")
+		if len(route) != 2 {
+			glog.Warningf("invalid tcp sni service format (port/hostname=namespace/service:port): %v", item)
+			continue
+		}
+		portHost := strings.Split(strings.TrimSpace(route[0]), "/")
+		service := strings.TrimSpace(route[1])
+		svc := tcpSNIServiceRegex.FindStringSubmatch(service)
+		if len(portHost) != 2 || svc == nil {
+			glog.Warningf("invalid tcp sni service format (port/hostname=namespace/service:port): %v", item)
+			continue
+		}
+		port, err := strconv.Atoi(portHost[0])
+		if err != nil || port <= 0 || port > 65535 {
+			glog.Warningf("invalid port of tcp sni service %v", item)
+			continue
+		}
+		if usedPorts[port] {
+			glog.Warningf("ignoring tcp sni service %v, port %v is already in use", item, port)
+			continue
+		}
+		hostname := strings.ToLower(portHost[1])
+		if hostname != "*" && !tcpSNIHostnameRegex.MatchString(hostname) {
+			glog.Warningf("invalid hostname of tcp sni service %v", item)
+			continue
+		}
+		// underscore isn't a valid char of a service name, so the name of
+		// the backend doesn't conflict with the backends of ingress resources
+		backendName := fmt.Sprintf("tcp_%v-%v-%v", svc[1], svc[2], svc[3])
+		frontend, found := frontends[port]
+		if !found {
+			frontend = &haproxyTCPSNIFrontend{Port: port}
+			frontends[port] = frontend
+		}
+		if hostname == "*" {
+			if frontend.DefaultBackend != "" {
+				glog.Warningf("ignoring duplicated default route of tcp sni port %v: %v", port, item)
+				continue
+			}
+			frontend.DefaultBackend = backendName
+		} else {
+			duplicated := false
+			for _, r := range frontend.Routes {
+				if r.Hostname == hostname {
+					duplicated = true
+				}
+			}
+			if duplicated {
+				glog.Warningf("ignoring duplicated hostname of tcp sni port %v: %v", port, item)
+				continue
+			}
+			frontend.Routes = append(frontend.Routes, &tcpSNIRoute{
+				Hostname: hostname,
+				Backend:  backendName,
+			})
+		}
+		if _, found := backends[backendName]; !found {
+			backends[backendName] = &haproxyTCPBackend{
+				Name:      backendName,
+				Service:   service,
+				Endpoints: anns.serviceEndpoints(svc[1], svc[2], svc[3], false),
+			}
+		}
+	}
+	ports := make([]int, 0, len(frontends))
+	for port := range frontends {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	frontendList := make([]*haproxyTCPSNIFrontend, len(ports))
+	for i, port := range ports {
+		frontendList[i] = frontends[port]
+	}
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	backendList := make([]*haproxyTCPBackend, len(names))
+	for i, name := range names {
+		backendList[i] = backends[name]
+	}
+	return frontendList, backendList
+}
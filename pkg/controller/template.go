@@ -18,8 +18,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"fmt"
 	"github.com/golang/glog"
-	"os/exec"
 	gotemplate "text/template"
 )
 
@@ -47,13 +48,30 @@ func (t *template) execute(conf *configuration) ([]byte, error) {
 	if err := t.tmpl.Execute(t.rawConfig, conf); err != nil {
 		return nil, err
 	}
-	cmd := exec.Command("sed", "/^ *$/d")
-	cmd.Stdin = t.rawConfig
-	cmd.Stdout = t.fmtConfig
-	if err := cmd.Run(); err != nil {
-		glog.Errorf("Template cleaning has failed: %v", err)
-		// TODO recover and return raw buffer
-		return nil, err
+	removeBlankLines(t.rawConfig.Bytes(), t.fmtConfig)
+	// buffers are reused on the next execution, the output
+	// could still be referenced, e.g. by a delayed reload
+	return append([]byte(nil), t.fmtConfig.Bytes()...), nil
+}
+
+// removeBlankLines removes lines which are empty or only have spaces,
+// left by the actions of the template
+func removeBlankLines(in []byte, out *bytes.Buffer) {
+	for len(in) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(in, '\n'); i >= 0 {
+			line, in = in[:i+1], in[i+1:]
+		} else {
+			line, in = append(in, '\n'), nil
+		}
+		if len(bytes.TrimLeft(line[:len(line)-1], " ")) > 0 {
+			out.Write(line)
+		}
 	}
-	return t.fmtConfig.Bytes(), nil
+}
+
+// configChecksum identifies a rendered configuration, so unchanged
+// configurations can be found without reading the current file
+func configChecksum(data []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(data))
 }
@@ -0,0 +1,86 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/flowcontrol"
+	"sync"
+	"time"
+)
+
+// reloadThrottle limits the rate of HAProxy reloads. Configurations which
+// arrive while the limit is reached aren't applied, only the last one is
+// kept and applied as soon as the limit allows, so a burst of updates
+// produces a single reload.
+type reloadThrottle struct {
+	mutex   sync.Mutex
+	locker  sync.Locker
+	limiter flowcontrol.RateLimiter
+	pending []byte
+	waiting bool
+}
+
+// newReloadThrottle creates a throttle whose callers of run and isPending hold
+// locker, which is also acquired before a delayed configuration is applied
+func newReloadThrottle(interval time.Duration, burst int, locker sync.Locker) *reloadThrottle {
+	if burst < 1 {
+		burst = 1
+	}
+	return &reloadThrottle{
+		locker:  locker,
+		limiter: flowcontrol.NewTokenBucketRateLimiter(float32(time.Second)/float32(interval), burst),
+	}
+}
+
+// run calls apply if the limit allows, otherwise data is saved and applied
+// later. Pending data is discarded whenever a newer one is applied.
+func (t *reloadThrottle) run(data []byte, apply func(data []byte) ([]byte, error)) ([]byte, bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.limiter.TryAccept() {
+		t.pending = nil
+		out, err := apply(data)
+		return out, true, err
+	}
+	t.pending = data
+	if !t.waiting {
+		t.waiting = true
+		glog.V(2).Infof("reload limit reached, delaying HAProxy reload")
+		go t.applyPending(apply)
+	}
+	return nil, false, nil
+}
+
+func (t *reloadThrottle) isPending() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.pending != nil
+}
+
+func (t *reloadThrottle) applyPending(apply func(data []byte) ([]byte, error)) {
+	t.limiter.Accept()
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.waiting = false
+	if t.pending != nil {
+		apply(t.pending)
+		t.pending = nil
+	}
+}
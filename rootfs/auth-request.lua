@@ -0,0 +1,171 @@
+-- Copyright 2017 The Kubernetes Authors. All rights reserved.
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--     http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- auth-request sends a subrequest with the credentials of the client, cookie
+-- and authorization headers, to a server of a backend. The request is
+-- authenticated if the server answers with a 2xx status code, which is saved
+-- in txn.auth_response_successful. The headers of the response are saved in
+-- req.auth_response_header.<name>, lower case and with dashes replaced by
+-- underscores, e.g. req.auth_response_header.x_auth_request_email.
+--
+-- Responses of requests with credentials are cached for <ttl> seconds, keyed
+-- by the backend, path, host, cookie and authorization header of the request.
+-- The cache is local to every HAProxy process, a ttl of 0 disables it.
+--
+-- usage: http-request lua.auth-request <backend> <path> <ttl>
+
+local timeout = 5
+local cache = {}
+local cache_size = 0
+local cache_max_size = 10000
+
+local function server_addr(backend)
+	local proxy = core.proxies[backend]
+	if proxy == nil then
+		return nil
+	end
+	for _, server in pairs(proxy.servers) do
+		local status = server:get_stats()["status"]
+		if status ~= nil and not status:find("^DOWN") and not status:find("^MAINT") then
+			local addr = server:get_addr()
+			local ip, port = addr:match("^(.+):(%d+)$")
+			if ip ~= nil then
+				return ip, tonumber(port)
+			end
+		end
+	end
+	return nil
+end
+
+local function request_header(headers, name)
+	local values = headers[name]
+	if values == nil or values[0] == nil then
+		return nil
+	end
+	return values[0]
+end
+
+-- cache_key identifies the credentials of a request, nil if the
+-- request doesn't have credentials and shouldn't be cached
+local function cache_key(txn, headers, backend, path)
+	local cookie = request_header(headers, "cookie")
+	local authorization = request_header(headers, "authorization")
+	if cookie == nil and authorization == nil then
+		return nil
+	end
+	return txn.c:sha1(table.concat({ backend, path, request_header(headers, "host") or "",
+		cookie or "", authorization or "" }, "\n"))
+end
+
+local function cache_get(key)
+	local entry = cache[key]
+	if entry == nil then
+		return nil
+	end
+	if entry.expires <= core.now().sec then
+		cache[key] = nil
+		cache_size = cache_size - 1
+		return nil
+	end
+	return entry
+end
+
+local function cache_set(key, ttl, entry)
+	if cache[key] == nil then
+		if cache_size >= cache_max_size then
+			local now = core.now().sec
+			for k, e in pairs(cache) do
+				if e.expires <= now then
+					cache[k] = nil
+					cache_size = cache_size - 1
+				end
+			end
+		end
+		if cache_size >= cache_max_size then
+			return
+		end
+		cache_size = cache_size + 1
+	end
+	entry.expires = core.now().sec + ttl
+	cache[key] = entry
+end
+
+local function apply_response(txn, entry)
+	for name, value in pairs(entry.headers) do
+		txn:set_var("req.auth_response_header." .. name, value)
+	end
+	txn:set_var("txn.auth_response_successful", entry.successful)
+end
+
+core.register_action("auth-request", { "http-req" }, function(txn, backend, path, ttl)
+	txn:set_var("txn.auth_response_successful", false)
+	local headers = txn.http:req_get_headers()
+	ttl = tonumber(ttl) or 0
+	local key = nil
+	if ttl > 0 then
+		key = cache_key(txn, headers, backend, path)
+		local entry = key and cache_get(key)
+		if entry ~= nil then
+			apply_response(txn, entry)
+			return
+		end
+	end
+	local ip, port = server_addr(backend)
+	if ip == nil then
+		txn:Warning("auth-request: backend " .. backend .. " doesn't have an available server")
+		return
+	end
+	local request = "GET " .. path .. " HTTP/1.0\r\n"
+	for _, name in ipairs({ "host", "cookie", "authorization" }) do
+		local value = request_header(headers, name)
+		if value ~= nil then
+			request = request .. name .. ": " .. value .. "\r\n"
+		end
+	end
+	request = request .. "x-forwarded-for: " .. txn.f:src() .. "\r\n" ..
+		"x-original-uri: " .. txn.f:url() .. "\r\n" ..
+		"connection: close\r\n\r\n"
+
+	local socket = core.tcp()
+	socket:settimeout(timeout)
+	if not socket:connect(ip, port) then
+		txn:Warning("auth-request: error connecting to " .. ip .. ":" .. port)
+		socket:close()
+		return
+	end
+	socket:send(request)
+	local status = socket:receive("*l")
+	local code = status and tonumber(status:match("^HTTP/%d%.%d (%d%d%d)"))
+	if code == nil then
+		txn:Warning("auth-request: invalid response from " .. ip .. ":" .. port)
+		socket:close()
+		return
+	end
+	local entry = { successful = code >= 200 and code < 300, headers = {} }
+	while true do
+		local line = socket:receive("*l")
+		if line == nil or line == "" then
+			break
+		end
+		local name, value = line:match("^([^:]+):%s*(.*)$")
+		if name ~= nil then
+			entry.headers[name:lower():gsub("-", "_")] = value
+		end
+	end
+	socket:close()
+	apply_response(txn, entry)
+	if key ~= nil and code < 500 then
+		cache_set(key, ttl, entry)
+	end
+end, 3)